@@ -2,108 +2,119 @@ package cgroups
 
 import (
 	"fmt"
-	"go-docker/utils"
-	"log"
 	"os"
-	"runtime"
 	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
 )
 
-func getMemBaseDir(containerId string) string {
-	return "/sys/fs/cgroup/memory/go-docker/" + containerId
-}
+const cgroupRoot = "/sys/fs/cgroup"
 
-func getPidsBaseDir(containerId string) string {
-	return "/sys/fs/cgroup/pids/go-docker/" + containerId
+// Resources are the limits applied to a container, negative value means unlimited and so does zero
+// memory, pids and cpus. Zero swap means no swap at all, swap is only limited along with memory
+type Resources struct {
+	MemoryMB int
+	SwapMB   int
+	Pids     int
+	Cpus     float64
 }
 
-func getCpuBaseDir(containerId string) string {
-	return "/sys/fs/cgroup/cpu/go-docker/" + containerId
+// Stats is a snapshot of resource usage of a container
+type Stats struct {
+	MemoryUsage uint64
+	CpuUsageNs  uint64
+	PidsCurrent uint64
 }
 
-func getCGroupDirs(containerId string) []string {
-	return []string{
-		getMemBaseDir(containerId),
-		getPidsBaseDir(containerId),
-		getCpuBaseDir(containerId),
-	}
+// Manager controls the cgroup of one container, so callers don't care about cgroup version
+type Manager interface {
+	// Create makes cgroup directories of the container
+	Create() error
+	// Apply moves a process into the container cgroup
+	Apply(pid int) error
+	// Set writes resource limits into the container cgroup
+	Set(res *Resources) error
+	// Stats reads current resource usage of the container
+	Stats() (*Stats, error)
+	// Freeze suspends (or resumes when frozen is false) all processes in the cgroup
+	Freeze(frozen bool) error
+	// Destroy removes cgroup directories of the container
+	Destroy() error
 }
 
-func CreateCGroup(containerId string, createCGroupDirs bool) {
-	cgroupDirs := getCGroupDirs(containerId)
+// NewResources returns resources without any limitation
+func NewResources() Resources {
+	return Resources{MemoryMB: -1, SwapMB: -1, Pids: -1, Cpus: -1}
+}
 
-	if createCGroupDirs {
-		if err := utils.CreateDirIfNotExist(cgroupDirs); err != nil {
-			log.Fatalf("Failed to creatre directories for cgroup: %v\n", err)
-		}
+// IsCGroupV2 detects if the host mounts cgroup with unified hierarchy (cgroup v2)
+func IsCGroupV2() bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(cgroupRoot, &st); err != nil {
+		return false
 	}
 
-	for _, cgroupDir := range cgroupDirs {
-		if err := os.WriteFile(cgroupDir+"/cgroup.procs", []byte(strconv.Itoa(os.Getpid())), 0700); err != nil {
-			log.Fatalf("Failed to write to cgroup procs file")
-		}
-	}
+	return st.Type == unix.CGROUP2_SUPER_MAGIC
 }
 
-func RemoveCGroups(containerId string) {
-	cgroupDirs := getCGroupDirs(containerId)
-
-	for _, cgroupDir := range cgroupDirs {
-		if err := os.Remove(cgroupDir); err != nil {
-			log.Fatalf("Failed to remove cgroup dir %s: %v\n", cgroupDir, err)
-		}
+// NewManager creates cgroup manager of the container based on cgroup version of the host
+func NewManager(containerId string) (Manager, error) {
+	if IsCGroupV2() {
+		return newV2Manager(cgroupRoot, containerId), nil
 	}
-}
 
-func setMemoryLimit(containerId string, limitMB int, swapLimitMB int) {
-	memFilePath := getMemBaseDir(containerId) + "/memory.limit_in_bytes"
-	swapFilePath := getMemBaseDir(containerId) + "/memory.memsw.limit_in_bytes"
+	return newV1Manager(cgroupRoot, containerId), nil
+}
 
-	if err := os.WriteFile(memFilePath, []byte(strconv.Itoa(limitMB*1024*1024)), 0644); err != nil {
-		log.Fatalf("Failed to write memory limit: %v\n", err)
+func writeCGroupFile(path string, value string) error {
+	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
 	}
 
-	if swapLimitMB >= 0 {
-		if err := os.WriteFile(swapFilePath, []byte(strconv.Itoa((limitMB*1024*1024)+(swapLimitMB*1024*1024))), 0644); err != nil {
-			log.Fatalf("Failed to write swap memory limit: %v\n", err)
-		}
-	}
+	return nil
 }
 
-func setCpuLimit(containerId string, limit float64) {
-	cfsPeriodPath := getCpuBaseDir(containerId) + "/cpu.cfs_period_us"
-	cfsQuotaPath := getCpuBaseDir(containerId) + "/cpu.cfs_quota_us"
-
-	if limit > float64(runtime.NumCPU()) {
-		fmt.Println("Ignore attempt to config CPU quota more than available CPUs")
-		return
+func readCGroupUint(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
 	}
 
-	if err := os.WriteFile(cfsPeriodPath, []byte(strconv.Itoa(1000000)), 0644); err != nil {
-		log.Fatalf("Failed to write CFS period: %v\n", err)
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return 0, nil
 	}
 
-	if err := os.WriteFile(cfsQuotaPath, []byte(strconv.Itoa(int(1000000*limit))), 0644); err != nil {
-		log.Fatalf("Failed to write CFS quota: %v\n", err)
-	}
+	return strconv.ParseUint(value, 10, 64)
 }
 
-func setPidsLimit(containerId string, limit int) {
-	maxProcPath := getPidsBaseDir(containerId) + "/pids.max"
-
-	if err := os.WriteFile(maxProcPath, []byte(strconv.Itoa(limit)), 0644); err != nil {
-		log.Fatalf("Failed to write pids limit: %v\n", err)
+func createCGroupDirs(dirs []string) error {
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create cgroup dir %s: %w", dir, err)
+		}
 	}
+
+	return nil
 }
 
-func ConfigCGroup(containerId string, mem int, swap int, pids int, cpus float64) {
-	if mem > 0 {
-		setMemoryLimit(containerId, mem, swap)
-	}
-	if cpus > 0 {
-		setCpuLimit(containerId, cpus)
+func removeCGroupDirs(dirs []string) error {
+	for _, dir := range dirs {
+		if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove cgroup dir %s: %w", dir, err)
+		}
 	}
-	if pids > 0 {
-		setPidsLimit(containerId, pids)
+
+	return nil
+}
+
+func applyPid(dirs []string, pid int) error {
+	for _, dir := range dirs {
+		if err := writeCGroupFile(dir+"/cgroup.procs", strconv.Itoa(pid)); err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
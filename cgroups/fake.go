@@ -0,0 +1,74 @@
+package cgroups
+
+import (
+	"os"
+)
+
+// FakeManager is a Manager backed by a plain directory instead of cgroupfs. It translates
+// resource limits into the same files as the real v1/v2 drivers, so limit translation can be
+// verified without root, and records every call for inspection.
+type FakeManager struct {
+	Pids      []int
+	Resources *Resources
+	Frozen    bool
+	Created   bool
+	Destroyed bool
+
+	driver interface {
+		Manager
+		dirs() []string
+	}
+}
+
+// NewFakeManager creates a fake manager writing cgroup files under root, in unified layout if unified is true
+func NewFakeManager(root string, containerId string, unified bool) *FakeManager {
+	fake := &FakeManager{}
+	if unified {
+		fake.driver = newV2Manager(root, containerId)
+	} else {
+		fake.driver = newV1Manager(root, containerId)
+	}
+
+	return fake
+}
+
+// Dirs returns directories the fake writes cgroup files to
+func (m *FakeManager) Dirs() []string {
+	return m.driver.dirs()
+}
+
+func (m *FakeManager) Create() error {
+	m.Created = true
+	return m.driver.Create()
+}
+
+func (m *FakeManager) Apply(pid int) error {
+	m.Pids = append(m.Pids, pid)
+	return m.driver.Apply(pid)
+}
+
+func (m *FakeManager) Set(res *Resources) error {
+	resCopy := *res
+	m.Resources = &resCopy
+	return m.driver.Set(res)
+}
+
+func (m *FakeManager) Stats() (*Stats, error) {
+	return &Stats{PidsCurrent: uint64(len(m.Pids))}, nil
+}
+
+func (m *FakeManager) Freeze(frozen bool) error {
+	m.Frozen = frozen
+	return m.driver.Freeze(frozen)
+}
+
+func (m *FakeManager) Destroy() error {
+	m.Destroyed = true
+	for _, dir := range m.driver.dirs() {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,208 @@
+package cgroups
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testContainerId = "0123456789ab"
+
+// readLimitFiles returns content of limit files under root, missing files are left out
+func readLimitFiles(t *testing.T, root string, files []string) map[string]string {
+	t.Helper()
+	contents := map[string]string{}
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(root, file))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			t.Fatalf("Failed to read %s: %v", file, err)
+		}
+		contents[file] = string(data)
+	}
+
+	return contents
+}
+
+func TestV1LimitTranslation(t *testing.T) {
+	memDir := "memory/go-docker/" + testContainerId
+	cpuDir := "cpu/go-docker/" + testContainerId
+	pidsDir := "pids/go-docker/" + testContainerId
+	files := []string{
+		memDir + "/memory.limit_in_bytes",
+		memDir + "/memory.memsw.limit_in_bytes",
+		cpuDir + "/cpu.cfs_period_us",
+		cpuDir + "/cpu.cfs_quota_us",
+		pidsDir + "/pids.max",
+	}
+
+	tests := []struct {
+		name string
+		res  Resources
+		want map[string]string
+	}{
+		{"unlimited", NewResources(), map[string]string{}},
+		{"memory without swap limit", Resources{MemoryMB: 100, SwapMB: -1, Pids: -1, Cpus: -1}, map[string]string{
+			memDir + "/memory.limit_in_bytes": "104857600",
+		}},
+		{"memory and swap", Resources{MemoryMB: 100, SwapMB: 50, Pids: -1, Cpus: -1}, map[string]string{
+			memDir + "/memory.limit_in_bytes":       "104857600",
+			memDir + "/memory.memsw.limit_in_bytes": "157286400",
+		}},
+		{"memory without swap", Resources{MemoryMB: 100, SwapMB: 0, Pids: -1, Cpus: -1}, map[string]string{
+			memDir + "/memory.limit_in_bytes":       "104857600",
+			memDir + "/memory.memsw.limit_in_bytes": "104857600",
+		}},
+		{"swap without memory is ignored", Resources{MemoryMB: -1, SwapMB: 50, Pids: -1, Cpus: -1}, map[string]string{}},
+		{"cpus", Resources{MemoryMB: -1, SwapMB: -1, Pids: -1, Cpus: 0.5}, map[string]string{
+			cpuDir + "/cpu.cfs_period_us": "1000000",
+			cpuDir + "/cpu.cfs_quota_us":  "500000",
+		}},
+		{"pids", Resources{MemoryMB: -1, SwapMB: -1, Pids: 64, Cpus: -1}, map[string]string{
+			pidsDir + "/pids.max": "64",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			fake := NewFakeManager(root, testContainerId, false)
+			if err := fake.Create(); err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			if err := fake.Set(&test.res); err != nil {
+				t.Fatalf("Set failed: %v", err)
+			}
+
+			got := readLimitFiles(t, root, files)
+			if len(got) != len(test.want) {
+				t.Errorf("Got files %v, want %v", got, test.want)
+			}
+			for file, want := range test.want {
+				if got[file] != want {
+					t.Errorf("%s = %q, want %q", file, got[file], want)
+				}
+			}
+			if *fake.Resources != test.res {
+				t.Errorf("Recorded resources %+v, want %+v", *fake.Resources, test.res)
+			}
+		})
+	}
+}
+
+func TestV2LimitTranslation(t *testing.T) {
+	dir := "go-docker/" + testContainerId
+	files := []string{
+		dir + "/memory.max",
+		dir + "/memory.swap.max",
+		dir + "/cpu.max",
+		dir + "/pids.max",
+	}
+
+	tests := []struct {
+		name string
+		res  Resources
+		want map[string]string
+	}{
+		{"unlimited", NewResources(), map[string]string{}},
+		{"memory without swap limit", Resources{MemoryMB: 100, SwapMB: -1, Pids: -1, Cpus: -1}, map[string]string{
+			dir + "/memory.max": "104857600",
+		}},
+		{"memory and swap", Resources{MemoryMB: 100, SwapMB: 50, Pids: -1, Cpus: -1}, map[string]string{
+			dir + "/memory.max":      "104857600",
+			dir + "/memory.swap.max": "52428800",
+		}},
+		{"memory without swap", Resources{MemoryMB: 100, SwapMB: 0, Pids: -1, Cpus: -1}, map[string]string{
+			dir + "/memory.max":      "104857600",
+			dir + "/memory.swap.max": "0",
+		}},
+		{"swap without memory is ignored", Resources{MemoryMB: -1, SwapMB: 50, Pids: -1, Cpus: -1}, map[string]string{}},
+		{"cpus", Resources{MemoryMB: -1, SwapMB: -1, Pids: -1, Cpus: 0.5}, map[string]string{
+			dir + "/cpu.max": "500000 1000000",
+		}},
+		{"pids", Resources{MemoryMB: -1, SwapMB: -1, Pids: 64, Cpus: -1}, map[string]string{
+			dir + "/pids.max": "64",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			fake := NewFakeManager(root, testContainerId, true)
+			if err := fake.Create(); err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			if err := fake.Set(&test.res); err != nil {
+				t.Fatalf("Set failed: %v", err)
+			}
+
+			got := readLimitFiles(t, root, files)
+			if len(got) != len(test.want) {
+				t.Errorf("Got files %v, want %v", got, test.want)
+			}
+			for file, want := range test.want {
+				if got[file] != want {
+					t.Errorf("%s = %q, want %q", file, got[file], want)
+				}
+			}
+		})
+	}
+}
+
+func TestV1FreezerIsOptional(t *testing.T) {
+	root := t.TempDir()
+	fake := NewFakeManager(root, testContainerId, false)
+	if err := fake.Create(); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := fake.Apply(42); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	for _, dir := range fake.Dirs() {
+		if filepath.Base(filepath.Dir(filepath.Dir(dir))) == "freezer" {
+			t.Errorf("Freezer dir %s used without freezer controller", dir)
+		}
+	}
+	if err := fake.Freeze(true); err == nil {
+		t.Errorf("Freeze succeeded without freezer controller")
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "freezer"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Create(); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := fake.Freeze(true); err != nil {
+		t.Fatalf("Freeze failed: %v", err)
+	}
+	got := readLimitFiles(t, root, []string{"freezer/go-docker/" + testContainerId + "/freezer.state"})
+	if got["freezer/go-docker/"+testContainerId+"/freezer.state"] != "FROZEN" {
+		t.Errorf("Freezer state %v, want FROZEN", got)
+	}
+}
+
+func TestFakeManagerRecordsCalls(t *testing.T) {
+	root := t.TempDir()
+	fake := NewFakeManager(root, testContainerId, true)
+	if err := fake.Create(); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := fake.Apply(42); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	procs := readLimitFiles(t, root, []string{"go-docker/" + testContainerId + "/cgroup.procs"})
+	if procs["go-docker/"+testContainerId+"/cgroup.procs"] != "42" {
+		t.Errorf("cgroup.procs = %v, want 42", procs)
+	}
+	if err := fake.Destroy(); err != nil {
+		t.Fatalf("Destroy failed: %v", err)
+	}
+	if !fake.Created || !fake.Destroyed || len(fake.Pids) != 1 || fake.Pids[0] != 42 {
+		t.Errorf("Calls not recorded: %+v", fake)
+	}
+	if _, err := os.Stat(filepath.Join(root, "go-docker", testContainerId)); !os.IsNotExist(err) {
+		t.Errorf("Container dir still exists after Destroy")
+	}
+}
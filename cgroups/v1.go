@@ -0,0 +1,128 @@
+package cgroups
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+)
+
+// v1Manager manages container cgroup in legacy hierarchy, one directory per controller
+type v1Manager struct {
+	root        string
+	containerId string
+}
+
+func newV1Manager(root string, containerId string) *v1Manager {
+	return &v1Manager{root: root, containerId: containerId}
+}
+
+func (m *v1Manager) memDir() string {
+	return m.root + "/memory/go-docker/" + m.containerId
+}
+
+func (m *v1Manager) pidsDir() string {
+	return m.root + "/pids/go-docker/" + m.containerId
+}
+
+func (m *v1Manager) cpuDir() string {
+	return m.root + "/cpu/go-docker/" + m.containerId
+}
+
+func (m *v1Manager) freezerDir() string {
+	return m.root + "/freezer/go-docker/" + m.containerId
+}
+
+// hasFreezer checks if freezer controller is mounted, it is only needed to pause containers
+func (m *v1Manager) hasFreezer() bool {
+	_, err := os.Stat(m.root + "/freezer")
+	return err == nil
+}
+
+func (m *v1Manager) dirs() []string {
+	dirs := []string{m.memDir(), m.pidsDir(), m.cpuDir()}
+	if m.hasFreezer() {
+		dirs = append(dirs, m.freezerDir())
+	}
+
+	return dirs
+}
+
+func (m *v1Manager) Create() error {
+	return createCGroupDirs(m.dirs())
+}
+
+func (m *v1Manager) Apply(pid int) error {
+	return applyPid(m.dirs(), pid)
+}
+
+func (m *v1Manager) Set(res *Resources) error {
+	if res.MemoryMB > 0 {
+		memBytes := res.MemoryMB * 1024 * 1024
+		if err := writeCGroupFile(m.memDir()+"/memory.limit_in_bytes", strconv.Itoa(memBytes)); err != nil {
+			return err
+		}
+		//memsw limit in v1 is the total of memory and swap
+		if res.SwapMB >= 0 {
+			swapBytes := memBytes + res.SwapMB*1024*1024
+			if err := writeCGroupFile(m.memDir()+"/memory.memsw.limit_in_bytes", strconv.Itoa(swapBytes)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if res.Cpus > 0 {
+		if res.Cpus > float64(runtime.NumCPU()) {
+			fmt.Println("Ignore attempt to config CPU quota more than available CPUs")
+		} else {
+			if err := writeCGroupFile(m.cpuDir()+"/cpu.cfs_period_us", strconv.Itoa(1000000)); err != nil {
+				return err
+			}
+			if err := writeCGroupFile(m.cpuDir()+"/cpu.cfs_quota_us", strconv.Itoa(int(1000000*res.Cpus))); err != nil {
+				return err
+			}
+		}
+	}
+
+	if res.Pids > 0 {
+		if err := writeCGroupFile(m.pidsDir()+"/pids.max", strconv.Itoa(res.Pids)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *v1Manager) Stats() (*Stats, error) {
+	var err error
+	stats := &Stats{}
+
+	if stats.MemoryUsage, err = readCGroupUint(m.memDir() + "/memory.usage_in_bytes"); err != nil {
+		return nil, err
+	}
+	//cpu and cpuacct controllers are normally mounted together
+	if stats.CpuUsageNs, err = readCGroupUint(m.cpuDir() + "/cpuacct.usage"); err != nil {
+		return nil, err
+	}
+	if stats.PidsCurrent, err = readCGroupUint(m.pidsDir() + "/pids.current"); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func (m *v1Manager) Freeze(frozen bool) error {
+	if !m.hasFreezer() {
+		return fmt.Errorf("freezer controller is not mounted under %s", m.root)
+	}
+	state := "THAWED"
+	if frozen {
+		state = "FROZEN"
+	}
+
+	return writeCGroupFile(m.freezerDir()+"/freezer.state", state)
+}
+
+func (m *v1Manager) Destroy() error {
+	return removeCGroupDirs(m.dirs())
+}
@@ -0,0 +1,143 @@
+package cgroups
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Controllers go-docker needs to be delegated down to container cgroups in unified hierarchy
+var unifiedControllers = []string{"cpu", "memory", "pids"}
+
+// v2Manager manages container cgroup in unified hierarchy, one directory for all controllers
+type v2Manager struct {
+	root        string
+	containerId string
+}
+
+func newV2Manager(root string, containerId string) *v2Manager {
+	return &v2Manager{root: root, containerId: containerId}
+}
+
+func (m *v2Manager) parentDir() string {
+	return m.root + "/go-docker"
+}
+
+func (m *v2Manager) dir() string {
+	return m.parentDir() + "/" + m.containerId
+}
+
+func (m *v2Manager) dirs() []string {
+	return []string{m.dir()}
+}
+
+func (m *v2Manager) enableControllers() {
+	//In unified hierarchy controllers must be enabled in every parent's subtree_control
+	for _, dir := range []string{m.root, m.parentDir()} {
+		for _, controller := range unifiedControllers {
+			if err := writeCGroupFile(dir+"/cgroup.subtree_control", "+"+controller); err != nil {
+				log.Printf("Failed to enable %s controller: %v\n", controller, err)
+			}
+		}
+	}
+}
+
+func (m *v2Manager) Create() error {
+	if err := createCGroupDirs([]string{m.parentDir()}); err != nil {
+		return err
+	}
+	m.enableControllers()
+
+	return createCGroupDirs(m.dirs())
+}
+
+func (m *v2Manager) Apply(pid int) error {
+	return applyPid(m.dirs(), pid)
+}
+
+func (m *v2Manager) Set(res *Resources) error {
+	if res.MemoryMB > 0 {
+		if err := writeCGroupFile(m.dir()+"/memory.max", strconv.Itoa(res.MemoryMB*1024*1024)); err != nil {
+			return err
+		}
+		//Unlike v1 memsw, swap limit in v2 doesn't include memory usage
+		if res.SwapMB >= 0 {
+			if err := writeCGroupFile(m.dir()+"/memory.swap.max", strconv.Itoa(res.SwapMB*1024*1024)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if res.Cpus > 0 {
+		if res.Cpus > float64(runtime.NumCPU()) {
+			fmt.Println("Ignore attempt to config CPU quota more than available CPUs")
+		} else {
+			//cpu.max takes "$QUOTA $PERIOD" in one line
+			cpuMax := fmt.Sprintf("%d %d", int(1000000*res.Cpus), 1000000)
+			if err := writeCGroupFile(m.dir()+"/cpu.max", cpuMax); err != nil {
+				return err
+			}
+		}
+	}
+
+	if res.Pids > 0 {
+		if err := writeCGroupFile(m.dir()+"/pids.max", strconv.Itoa(res.Pids)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readCpuUsage(cpuStatPath string) (uint64, error) {
+	file, err := os.Open(cpuStatPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			usage, err := strconv.ParseUint(fields[1], 10, 64)
+			return usage * 1000, err
+		}
+	}
+
+	return 0, scanner.Err()
+}
+
+func (m *v2Manager) Stats() (*Stats, error) {
+	var err error
+	stats := &Stats{}
+
+	if stats.MemoryUsage, err = readCGroupUint(m.dir() + "/memory.current"); err != nil {
+		return nil, err
+	}
+	if stats.CpuUsageNs, err = readCpuUsage(m.dir() + "/cpu.stat"); err != nil {
+		return nil, err
+	}
+	if stats.PidsCurrent, err = readCGroupUint(m.dir() + "/pids.current"); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func (m *v2Manager) Freeze(frozen bool) error {
+	state := "0"
+	if frozen {
+		state = "1"
+	}
+
+	return writeCGroupFile(m.dir()+"/cgroup.freeze", state)
+}
+
+func (m *v2Manager) Destroy() error {
+	return removeCGroupDirs(m.dirs())
+}
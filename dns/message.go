@@ -0,0 +1,179 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Record types and class handled by the embedded server
+const (
+	typeA    uint16 = 1
+	typePTR  uint16 = 12
+	typeAAAA uint16 = 28
+	classIN  uint16 = 1
+)
+
+// Response codes
+const (
+	rcodeSuccess        = 0
+	rcodeFormatError    = 1
+	rcodeServerFailure  = 2
+	rcodeNotImplemented = 4
+)
+
+const headerSize = 12
+
+// TTL of answers for containers, short as containers come and go
+const answerTTL = 10
+
+var errMalformedMessage = errors.New("malformed DNS message")
+
+// question is the single question of a query, raw keeps its wire format to be copied into response
+type question struct {
+	name  string
+	qtype uint16
+	class uint16
+	raw   []byte
+}
+
+// answer is one resource record, data is rdata in wire format
+type answer struct {
+	rtype uint16
+	data  []byte
+}
+
+// readName reads a possibly compressed domain name at offset, it returns the name in lower case
+// without the trailing dot and the offset right after the name
+func readName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; jumps++ {
+		if offset >= len(msg) || jumps > 64 {
+			return "", 0, errMalformedMessage
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), end, nil
+		case length&0xC0 == 0xC0:
+			if offset+1 >= len(msg) {
+				return "", 0, errMalformedMessage
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3FFF)
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, errMalformedMessage
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+// encodeName encodes a domain name in wire format without compression
+func encodeName(name string) []byte {
+	var buf []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+
+	return append(buf, 0)
+}
+
+// parseQuery returns the question of a standard query with exactly one question
+func parseQuery(msg []byte) (*question, error) {
+	if len(msg) < headerSize {
+		return nil, errMalformedMessage
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 != 0 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return nil, errMalformedMessage
+	}
+
+	name, offset, err := readName(msg, headerSize)
+	if err != nil || offset+4 > len(msg) {
+		return nil, errMalformedMessage
+	}
+
+	return &question{
+		name:  name,
+		qtype: binary.BigEndian.Uint16(msg[offset:]),
+		class: binary.BigEndian.Uint16(msg[offset+2:]),
+		raw:   msg[headerSize : offset+4],
+	}, nil
+}
+
+// getOpcode returns opcode of the message, only standard queries (0) are answered
+func getOpcode(msg []byte) int {
+	return int(binary.BigEndian.Uint16(msg[2:])>>11) & 0xF
+}
+
+// buildResponse builds an authoritative response to query, answers refer to the name of question
+func buildResponse(query []byte, q *question, rcode int, answers []answer) []byte {
+	resp := make([]byte, headerSize, 512)
+	copy(resp, query[:2])
+	//Keep opcode and RD flag of query, set QR, AA and RA
+	flags := binary.BigEndian.Uint16(query[2:])&0x7900 | 0x8000 | 0x0400 | 0x0080 | uint16(rcode)
+	binary.BigEndian.PutUint16(resp[2:], flags)
+
+	if q != nil {
+		binary.BigEndian.PutUint16(resp[4:], 1)
+		resp = append(resp, q.raw...)
+	}
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+
+	for _, ans := range answers {
+		//Name is a pointer to the question right after header
+		resp = append(resp, 0xC0, headerSize)
+		resp = binary.BigEndian.AppendUint16(resp, ans.rtype)
+		resp = binary.BigEndian.AppendUint16(resp, classIN)
+		resp = binary.BigEndian.AppendUint32(resp, answerTTL)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(ans.data)))
+		resp = append(resp, ans.data...)
+	}
+
+	return resp
+}
+
+// parseReverseName returns the address of a PTR query name under in-addr.arpa or ip6.arpa
+func parseReverseName(name string) net.IP {
+	if prefix, found := strings.CutSuffix(name, ".in-addr.arpa"); found {
+		octets := strings.Split(prefix, ".")
+		if len(octets) != 4 {
+			return nil
+		}
+		for i, j := 0, len(octets)-1; i < j; i, j = i+1, j-1 {
+			octets[i], octets[j] = octets[j], octets[i]
+		}
+		return net.ParseIP(strings.Join(octets, ".")).To4()
+	}
+
+	if prefix, found := strings.CutSuffix(name, ".ip6.arpa"); found {
+		nibbles := strings.Split(prefix, ".")
+		if len(nibbles) != 32 {
+			return nil
+		}
+		var hex strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			hex.WriteString(nibbles[i])
+			if i%4 == 0 && i > 0 {
+				hex.WriteString(":")
+			}
+		}
+		return net.ParseIP(hex.String())
+	}
+
+	return nil
+}
@@ -0,0 +1,260 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// buildQuery returns a standard query with RD set and one question in wire format
+func buildQuery(id uint16, name string, qtype uint16) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = binary.BigEndian.AppendUint16(msg, 0x0100)
+	msg = append(msg, 0, 1, 0, 0, 0, 0, 0, 0)
+	msg = append(msg, encodeName(name)...)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+
+	return binary.BigEndian.AppendUint16(msg, classIN)
+}
+
+func TestReadName(t *testing.T) {
+	//Header is left zero, names start right after it
+	header := make([]byte, headerSize)
+	tests := []struct {
+		name    string
+		msg     []byte
+		offset  int
+		want    string
+		wantEnd int
+		wantErr bool
+	}{
+		{name: "plain", msg: append(header, 3, 'w', 'e', 'b', 3, 'a', 'p', 'p', 0), offset: 12, want: "web.app", wantEnd: 21},
+		{name: "lower case", msg: append(header, 3, 'W', 'e', 'B', 0), offset: 12, want: "web", wantEnd: 17},
+		{name: "root", msg: append(header, 0), offset: 12, want: "", wantEnd: 13},
+		{name: "pointer", msg: append(header, 3, 'a', 'p', 'p', 0, 3, 'w', 'e', 'b', 0xC0, 12), offset: 17, want: "web.app", wantEnd: 23},
+		{name: "pointer only", msg: append(header, 3, 'a', 'p', 'p', 0, 0xC0, 12), offset: 17, want: "app", wantEnd: 19},
+		{name: "chained pointers", msg: append(header, 3, 'a', 'p', 'p', 0, 1, 'b', 0xC0, 12, 1, 'c', 0xC0, 17), offset: 21, want: "c.b.app", wantEnd: 25},
+		{name: "pointer loop", msg: append(header, 0xC0, 12), offset: 12, wantErr: true},
+		{name: "pointers to each other", msg: append(header, 1, 'a', 0xC0, 16, 1, 'b', 0xC0, 12), offset: 12, wantErr: true},
+		{name: "pointer past end", msg: append(header, 0xC0, 0xFF), offset: 12, wantErr: true},
+		{name: "pointer cut", msg: append(header, 1, 'a', 0xC0), offset: 12, wantErr: true},
+		{name: "label past end", msg: append(header, 10, 'a', 'b'), offset: 12, wantErr: true},
+		{name: "no terminator", msg: append(header, 1, 'a'), offset: 12, wantErr: true},
+		{name: "offset past end", msg: header, offset: 12, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, end, err := readName(test.msg, test.offset)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("readName = %q, want error", got)
+				}
+				return
+			}
+			if err != nil || got != test.want || end != test.wantEnd {
+				t.Errorf("readName = %q, %d, %v, want %q, %d", got, end, err, test.want, test.wantEnd)
+			}
+		})
+	}
+}
+
+func TestEncodeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want []byte
+	}{
+		{"web.app", []byte{3, 'w', 'e', 'b', 3, 'a', 'p', 'p', 0}},
+		{"web.app.", []byte{3, 'w', 'e', 'b', 3, 'a', 'p', 'p', 0}},
+		{"", []byte{0}},
+		{".", []byte{0}},
+	}
+
+	for _, test := range tests {
+		if got := encodeName(test.name); !bytes.Equal(got, test.want) {
+			t.Errorf("encodeName(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	query := buildQuery(0x1234, "Web.App", typeAAAA)
+	q, err := parseQuery(query)
+	if err != nil {
+		t.Fatalf("parseQuery failed: %v", err)
+	}
+	if q.name != "web.app" || q.qtype != typeAAAA || q.class != classIN {
+		t.Errorf("parseQuery = %+v, want web.app AAAA IN", q)
+	}
+	if !bytes.Equal(q.raw, query[headerSize:]) {
+		t.Errorf("Raw question %v, want %v", q.raw, query[headerSize:])
+	}
+
+	response := append([]byte{}, query...)
+	response[2] |= 0x80
+	twoQuestions := append([]byte{}, query...)
+	twoQuestions[5] = 2
+	noQuestion := append([]byte{}, query[:headerSize]...)
+	noQuestion[5] = 0
+	malformed := map[string][]byte{
+		"response":      response,
+		"two questions": twoQuestions,
+		"no question":   noQuestion,
+		"empty":         nil,
+	}
+	for name, msg := range malformed {
+		if q, err := parseQuery(msg); err == nil {
+			t.Errorf("parseQuery of %s = %+v, want error", name, q)
+		}
+	}
+}
+
+// Every prefix of a valid query is a truncated packet, none of them may panic or parse
+func TestTruncatedQuery(t *testing.T) {
+	query := buildQuery(7, "db.backend.internal", typeA)
+	r := &resolver{networkName: "test"}
+	for n := 0; n < len(query); n++ {
+		if q, err := parseQuery(query[:n]); err == nil {
+			t.Errorf("parseQuery of %d of %d bytes = %+v, want error", n, len(query), q)
+		}
+
+		response := r.handle(query[:n], &net.UDPAddr{})
+		if n < headerSize {
+			if response != nil {
+				t.Errorf("Response to %d bytes, want none", n)
+			}
+			continue
+		}
+		if len(response) < headerSize || response[3]&0xF != rcodeFormatError {
+			t.Errorf("Response to %d bytes is %v, want format error", n, response)
+		}
+	}
+}
+
+func TestHandleNonStandardQuery(t *testing.T) {
+	query := buildQuery(7, "web", typeA)
+	//Opcode 2 is a server status request
+	query[2] |= 2 << 3
+	response := (&resolver{}).handle(query, &net.UDPAddr{})
+	if len(response) != headerSize || response[3]&0xF != rcodeNotImplemented {
+		t.Errorf("Response %v, want header only with not implemented", response)
+	}
+}
+
+func TestBuildResponse(t *testing.T) {
+	query := buildQuery(0xBEEF, "web", typeA)
+	q, err := parseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers := []answer{{rtype: typeA, data: []byte{10, 0, 0, 2}}, {rtype: typeA, data: []byte{10, 0, 0, 3}}}
+	response := buildResponse(query, q, rcodeSuccess, answers)
+
+	if binary.BigEndian.Uint16(response) != 0xBEEF {
+		t.Errorf("Response ID %x, want beef", binary.BigEndian.Uint16(response))
+	}
+	//QR, opcode 0, AA, RD copied from query, RA, rcode 0
+	if flags := binary.BigEndian.Uint16(response[2:]); flags != 0x8580 {
+		t.Errorf("Response flags %04x, want 8580", flags)
+	}
+	if qd, an := binary.BigEndian.Uint16(response[4:]), binary.BigEndian.Uint16(response[6:]); qd != 1 || an != 2 {
+		t.Errorf("Response has %d questions and %d answers, want 1 and 2", qd, an)
+	}
+
+	//Answers name the question by pointer, so they read back as its name
+	offset := headerSize + len(q.raw)
+	for i, ans := range answers {
+		name, end, err := readName(response, offset)
+		if err != nil || name != "web" || end != offset+2 {
+			t.Fatalf("Answer %d name %q, %v, want pointer to web", i, name, err)
+		}
+		rtype := binary.BigEndian.Uint16(response[end:])
+		ttl := binary.BigEndian.Uint32(response[end+4:])
+		length := int(binary.BigEndian.Uint16(response[end+8:]))
+		data := response[end+10 : end+10+length]
+		if rtype != ans.rtype || ttl != answerTTL || !bytes.Equal(data, ans.data) {
+			t.Errorf("Answer %d is type %d ttl %d data %v, want %d %d %v", i, rtype, ttl, data, ans.rtype, answerTTL, ans.data)
+		}
+		offset = end + 10 + length
+	}
+	if offset != len(response) {
+		t.Errorf("Response has %d bytes after answers", len(response)-offset)
+	}
+
+	//Error response without question keeps only the header
+	if response := buildResponse(query, nil, rcodeFormatError, nil); len(response) != headerSize || response[3]&0xF != rcodeFormatError {
+		t.Errorf("Error response %v, want header only with format error", response)
+	}
+}
+
+func TestParseReverseName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"2.0.17.172.in-addr.arpa", "172.17.0.2"},
+		{"2.0.17.in-addr.arpa", ""},
+		{"x.0.17.172.in-addr.arpa", ""},
+		{"2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa", "fd00::2"},
+		{"2.0.0.ip6.arpa", ""},
+		{"web.app", ""},
+	}
+
+	for _, test := range tests {
+		got := parseReverseName(test.name)
+		if (test.want == "" && got != nil) || (test.want != "" && !got.Equal(net.ParseIP(test.want))) {
+			t.Errorf("parseReverseName(%q) = %v, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTCPMessage(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	query := buildQuery(1, "web", typeA)
+	go func() {
+		writeTCPMessage(client, query)
+		writeTCPMessage(client, nil)
+	}()
+
+	got, err := readTCPMessage(server)
+	if err != nil || !bytes.Equal(got, query) {
+		t.Fatalf("readTCPMessage = %v, %v, want %v", got, err, query)
+	}
+	if got, err := readTCPMessage(server); err != nil || len(got) != 0 {
+		t.Errorf("readTCPMessage of empty message = %v, %v", got, err)
+	}
+}
+
+func TestTCPMessageLengthPrefix(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	query := buildQuery(1, "web", typeA)
+	go func() {
+		writeTCPMessage(server, query)
+	}()
+	prefix := make([]byte, 2)
+	if _, err := client.Read(prefix); err != nil {
+		t.Fatal(err)
+	}
+	if int(binary.BigEndian.Uint16(prefix)) != len(query) {
+		t.Errorf("Length prefix %d, want %d", binary.BigEndian.Uint16(prefix), len(query))
+	}
+	client.Close()
+
+	//Message shorter than its length prefix is an error, not a short message
+	client, server = net.Pipe()
+	go func() {
+		client.Write([]byte{0, 40})
+		client.Write(query[:10])
+		client.Close()
+	}()
+	if got, err := readTCPMessage(server); err == nil {
+		t.Errorf("readTCPMessage of cut message = %v, want error", got)
+	}
+	server.Close()
+}
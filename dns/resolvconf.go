@@ -0,0 +1,76 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Host resolver configs, the one of systemd-resolved lists real upstream servers instead of the stub
+var hostResolvConfPaths = []string{
+	"/var/run/systemd/resolve/resolv.conf",
+	"/etc/gockerresolv.conf",
+	"/etc/resolv.conf",
+}
+
+// ResolvConf is the content of resolv.conf which matters to containers
+type ResolvConf struct {
+	Nameservers []string
+	Search      []string
+	Options     []string
+}
+
+func parseResolvConf(path string) (*ResolvConf, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	conf := &ResolvConf{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			conf.Nameservers = append(conf.Nameservers, fields[1])
+		case "search", "domain":
+			conf.Search = fields[1:]
+		case "options":
+			conf.Options = append(conf.Options, fields[1:]...)
+		}
+	}
+
+	return conf, scanner.Err()
+}
+
+// GetHostResolvConf returns resolver config of host, empty if host has none
+func GetHostResolvConf() (*ResolvConf, error) {
+	for _, path := range hostResolvConfPaths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		return parseResolvConf(path)
+	}
+
+	return &ResolvConf{}, nil
+}
+
+func (conf *ResolvConf) String() string {
+	var content strings.Builder
+	for _, server := range conf.Nameservers {
+		fmt.Fprintf(&content, "nameserver %s\n", server)
+	}
+	if len(conf.Search) > 0 {
+		fmt.Fprintf(&content, "search %s\n", strings.Join(conf.Search, " "))
+	}
+	if len(conf.Options) > 0 {
+		fmt.Fprintf(&content, "options %s\n", strings.Join(conf.Options, " "))
+	}
+
+	return content.String()
+}
@@ -0,0 +1,400 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"go-docker/state"
+	"go-docker/utils"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Time to wait for an upstream server before trying the next one
+const upstreamTimeout = 2 * time.Second
+
+// Time a TCP client may stay idle between queries before its connection is closed
+const tcpIdleTimeout = 10 * time.Second
+
+func getDNSPath() string {
+	return utils.GetDockerNetworkPath() + "/dns"
+}
+
+func getPidPath(networkName string) string {
+	return getDNSPath() + "/" + networkName + ".pid"
+}
+
+func getLogPath(networkName string) string {
+	return getDNSPath() + "/" + networkName + ".log"
+}
+
+// getServerPid returns pid of the DNS server of network, 0 if it is not running
+func getServerPid(networkName string) int {
+	data, err := os.ReadFile(getPidPath(networkName))
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	//Pid may be reused by another process after reboot
+	cmdline, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/cmdline")
+	if err != nil || !strings.Contains(string(cmdline), "dns-server") {
+		return 0
+	}
+
+	return pid
+}
+
+// EnsureServer starts the DNS server of network on its gateway address, unless it is running already
+func EnsureServer(networkName string, gateway string) error {
+	if getServerPid(networkName) > 0 {
+		return nil
+	}
+	if err := os.MkdirAll(getDNSPath(), utils.File_OtherReadExecute); err != nil {
+		return err
+	}
+
+	//Bind in current process so errors show up at once, sockets are passed to server as fd 3 (UDP)
+	//and fd 4 (TCP), which resolvers retry on when an answer is truncated
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(gateway, "53"))
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", gateway, err)
+	}
+	socketFile, err := conn.(*net.UDPConn).File()
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	defer socketFile.Close()
+	listener, err := net.Listen("tcp", net.JoinHostPort(gateway, "53"))
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", gateway, err)
+	}
+	listenerFile, err := listener.(*net.TCPListener).File()
+	listener.Close()
+	if err != nil {
+		return err
+	}
+	defer listenerFile.Close()
+
+	logFile, err := os.OpenFile(getLogPath(networkName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, utils.File_OtherReadOnly)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command("/proc/self/exe", "dns-server", networkName)
+	cmd.ExtraFiles = []*os.File{socketFile, listenerFile}
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &unix.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+
+	return os.WriteFile(getPidPath(networkName), []byte(strconv.Itoa(pid)), utils.File_OtherReadOnly)
+}
+
+// StopServer stops the DNS server of network if it is running
+func StopServer(networkName string) error {
+	if pid := getServerPid(networkName); pid > 0 {
+		if err := unix.Kill(pid, unix.SIGTERM); err != nil && err != unix.ESRCH {
+			return err
+		}
+	}
+
+	os.Remove(getLogPath(networkName))
+	if err := os.Remove(getPidPath(networkName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// getEndpointAddresses returns addresses of an endpoint which are answered for a query type
+func getEndpointAddresses(endpoint *state.Endpoint, qtype uint16) []net.IP {
+	var addresses []net.IP
+	if ip := net.ParseIP(endpoint.IPAddress); ip != nil && qtype == typeA {
+		addresses = append(addresses, ip.To4())
+	}
+	if ip := net.ParseIP(endpoint.IPv6Address); ip != nil && qtype == typeAAAA {
+		addresses = append(addresses, ip)
+	}
+
+	return addresses
+}
+
+// getContainerNames returns names a container is known by on the network, the first one is its canonical name
+func getContainerNames(c *state.Container, endpoint *state.Endpoint) []string {
+	var names []string
+	if c.Name != "" {
+		names = append(names, strings.ToLower(c.Name))
+	}
+	names = append(names, c.Id[:12])
+	for _, alias := range endpoint.Aliases {
+		names = append(names, strings.ToLower(alias))
+	}
+
+	return names
+}
+
+type resolver struct {
+	networkName string
+}
+
+// getRunningEndpoints returns running containers on the network with their endpoints
+func (r *resolver) getRunningEndpoints() map[*state.Container]*state.Endpoint {
+	endpoints := map[*state.Container]*state.Endpoint{}
+	containers, err := state.List()
+	if err != nil {
+		log.Printf("Failed to list containers: %v\n", err)
+		return endpoints
+	}
+	for _, c := range containers {
+		if endpoint, found := c.Network.Networks[r.networkName]; found && c.IsRunning() {
+			endpoints[c] = endpoint
+		}
+	}
+
+	return endpoints
+}
+
+// lookup answers a question from containers on the network, found is false if the name is unknown
+func (r *resolver) lookup(q *question) ([]answer, bool) {
+	var answers []answer
+	endpoints := r.getRunningEndpoints()
+
+	if q.qtype == typePTR {
+		ip := parseReverseName(q.name)
+		if ip == nil {
+			return nil, false
+		}
+		for c, endpoint := range endpoints {
+			addresses := append(getEndpointAddresses(endpoint, typeA), getEndpointAddresses(endpoint, typeAAAA)...)
+			for _, address := range addresses {
+				if address.Equal(ip) {
+					answers = append(answers, answer{rtype: typePTR, data: encodeName(getContainerNames(c, endpoint)[0])})
+				}
+			}
+		}
+		return answers, len(answers) > 0
+	}
+
+	found := false
+	for c, endpoint := range endpoints {
+		for _, name := range getContainerNames(c, endpoint) {
+			if name != q.name {
+				continue
+			}
+			found = true
+			for _, address := range getEndpointAddresses(endpoint, q.qtype) {
+				if q.qtype == typeA {
+					answers = append(answers, answer{rtype: typeA, data: address.To4()})
+				} else {
+					answers = append(answers, answer{rtype: typeAAAA, data: address.To16()})
+				}
+			}
+			break
+		}
+	}
+
+	return answers, found
+}
+
+// getUpstreams returns servers a query of client is forwarded to, DNS servers given to the
+// client container take precedence over servers of host
+func (r *resolver) getUpstreams(client net.Addr) []string {
+	var clientIP net.IP
+	switch addr := client.(type) {
+	case *net.UDPAddr:
+		clientIP = addr.IP
+	case *net.TCPAddr:
+		clientIP = addr.IP
+	}
+	if clientIP != nil {
+		for c, endpoint := range r.getRunningEndpoints() {
+			isClient := net.ParseIP(endpoint.IPAddress).Equal(clientIP) || net.ParseIP(endpoint.IPv6Address).Equal(clientIP)
+			if isClient && len(c.DNS.Servers) > 0 {
+				return c.DNS.Servers
+			}
+		}
+	}
+
+	conf, err := GetHostResolvConf()
+	if err != nil {
+		log.Printf("Failed to read resolver config of host: %v\n", err)
+		return nil
+	}
+
+	return conf.Nameservers
+}
+
+// readTCPMessage reads a DNS message prefixed with its length, as sent over TCP
+func readTCPMessage(conn net.Conn) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, message); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// writeTCPMessage writes a DNS message prefixed with its length
+func writeTCPMessage(conn net.Conn, message []byte) error {
+	_, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(message))))
+	if err == nil {
+		_, err = conn.Write(message)
+	}
+
+	return err
+}
+
+// exchange sends query to an upstream server over network udp or tcp, and reads its response
+func exchange(network string, upstream string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, net.JoinHostPort(upstream, "53"), upstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+// forward sends query to upstream servers in turn over the network the client asked on, and returns
+// the first response. Truncated UDP response is passed on as it is, so the client retries over TCP
+func (r *resolver) forward(network string, query []byte, upstreams []string) ([]byte, error) {
+	for _, upstream := range upstreams {
+		if response, err := exchange(network, upstream, query); err == nil {
+			return response, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no upstream server answered")
+}
+
+func (r *resolver) handle(query []byte, client net.Addr) []byte {
+	if len(query) < headerSize {
+		return nil
+	}
+	if getOpcode(query) != 0 {
+		return buildResponse(query, nil, rcodeNotImplemented, nil)
+	}
+	q, err := parseQuery(query)
+	if err != nil {
+		return buildResponse(query, nil, rcodeFormatError, nil)
+	}
+
+	if q.class == classIN && (q.qtype == typeA || q.qtype == typeAAAA || q.qtype == typePTR) {
+		if answers, found := r.lookup(q); found {
+			return buildResponse(query, q, rcodeSuccess, answers)
+		}
+	} else if q.class == classIN && !strings.Contains(q.name, ".") {
+		//Other records of container names don't exist, answer with no data instead of asking upstream
+		for c, endpoint := range r.getRunningEndpoints() {
+			for _, name := range getContainerNames(c, endpoint) {
+				if name == q.name {
+					return buildResponse(query, q, rcodeSuccess, nil)
+				}
+			}
+		}
+	}
+
+	network := "udp"
+	if _, ok := client.(*net.TCPAddr); ok {
+		network = "tcp"
+	}
+	response, err := r.forward(network, query, r.getUpstreams(client))
+	if err != nil {
+		log.Printf("Failed to forward query of %s: %v\n", q.name, err)
+		return buildResponse(query, q, rcodeServerFailure, nil)
+	}
+
+	return response
+}
+
+// serveTCP answers queries of one TCP client, which may send several before it closes the connection
+func (r *resolver) serveTCP(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		if response := r.handle(query, conn.RemoteAddr()); response != nil {
+			if err := writeTCPMessage(conn, response); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// RunServer serves DNS of a network, sockets are bound by the parent and passed as fd 3 (UDP) and
+// fd 4 (TCP). Names of containers on the network are answered locally, other queries are forwarded upstream
+func RunServer(networkName string) {
+	conn, err := net.FilePacketConn(os.NewFile(3, "dns"))
+	if err != nil {
+		log.Fatalf("Failed to open DNS socket: %v\n", err)
+	}
+	listener, err := net.FileListener(os.NewFile(4, "dns-tcp"))
+	if err != nil {
+		log.Fatalf("Failed to open DNS TCP socket: %v\n", err)
+	}
+
+	r := &resolver{networkName: networkName}
+	go func() {
+		for {
+			tcpConn, err := listener.Accept()
+			if err != nil {
+				log.Fatalf("Failed to accept DNS TCP connection: %v\n", err)
+			}
+			go r.serveTCP(tcpConn)
+		}
+	}()
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Fatalf("Failed to read from DNS socket: %v\n", err)
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+
+		go func(query []byte, client net.Addr) {
+			if response := r.handle(query, client); response != nil {
+				conn.WriteTo(response, client)
+			}
+		}(query, client)
+	}
+}
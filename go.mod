@@ -22,6 +22,6 @@ require (
 
 require (
 	github.com/google/go-containerregistry v0.16.1
-	github.com/vishvananda/netns v0.0.0-20191106174202-0a2b9b5464df // indirect
+	github.com/vishvananda/netns v0.0.0-20191106174202-0a2b9b5464df
 	golang.org/x/sys v0.8.0
 )
@@ -16,13 +16,21 @@ type imageEntries map[string]string
 
 type imagesDB map[string]imageEntries
 
-type imageConfig struct {
-	Env []string `json:"Env"`
-	Cmd []string `json:"Cmd"`
+// ImageConfig is the runtime config of OCI image, used as defaults of containers created from it
+type ImageConfig struct {
+	User         string              `json:"User"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+	Env          []string            `json:"Env"`
+	Entrypoint   []string            `json:"Entrypoint"`
+	Cmd          []string            `json:"Cmd"`
+	Volumes      map[string]struct{} `json:"Volumes"`
+	WorkingDir   string              `json:"WorkingDir"`
+	Labels       map[string]string   `json:"Labels"`
+	StopSignal   string              `json:"StopSignal"`
 }
 
-type imageInfo struct {
-	Config imageConfig `json:"config"`
+type ImageInfo struct {
+	Config ImageConfig `json:"config"`
 }
 
 func GetImageNameAndTag(src string) (string, string) {
@@ -220,7 +228,7 @@ func DownloadImageIfRequired(src string) string {
 	}
 }
 
-func ParseContainerConfig(imgShaHex string) imageInfo {
+func ParseContainerConfig(imgShaHex string) ImageInfo {
 	imagesConfigPath := GetConfigPathForImage(imgShaHex)
 
 	data, err := os.ReadFile(imagesConfigPath)
@@ -228,7 +236,7 @@ func ParseContainerConfig(imgShaHex string) imageInfo {
 		log.Fatalf("Failed to read image %s config file: %v\n", imgShaHex, err)
 	}
 
-	imgInfo := imageInfo{}
+	imgInfo := ImageInfo{}
 	if err := json.Unmarshal(data, &imgInfo); err != nil {
 		log.Fatalf("Failed to parse image info data")
 	}
@@ -0,0 +1,216 @@
+package logs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"go-docker/state"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Interval to poll log file for new entries in follow mode
+const followInterval = 200 * time.Millisecond
+
+type Options struct {
+	Follow     bool
+	Since      time.Time
+	Tail       int
+	Timestamps bool
+}
+
+// ParseSince accepts RFC3339 time, unix timestamp, or duration relative to now like 10m
+func ParseSince(since string) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, since); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if seconds, err := strconv.ParseInt(since, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid since value %s", since)
+}
+
+// GetLogPath returns the file capturing output of a container
+func GetLogPath(containerId string) string {
+	return state.GetContainerHome(containerId) + "/" + containerId + "-json.log"
+}
+
+type entryReader struct {
+	reader  *bufio.Reader
+	pending []byte
+}
+
+// next returns next complete entry, or nil if the file has no complete line yet
+func (r *entryReader) next() (*Entry, error) {
+	for {
+		line, err := r.reader.ReadBytes('\n')
+		r.pending = append(r.pending, line...)
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		data := r.pending
+		r.pending = nil
+		entry := &Entry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			log.Printf("Skip invalid log line: %v\n", err)
+			continue
+		}
+		return entry, nil
+	}
+}
+
+func printEntry(entry *Entry, opts *Options) {
+	out := os.Stdout
+	if entry.Stream == StreamStderr {
+		out = os.Stderr
+	}
+	if opts.Timestamps {
+		fmt.Fprintf(out, "%s %s", entry.Time.Format(time.RFC3339Nano), entry.Log)
+	} else {
+		fmt.Fprint(out, entry.Log)
+	}
+}
+
+func readAllEntries(reader *entryReader, opts *Options, entries []*Entry) ([]*Entry, error) {
+	for {
+		entry, err := reader.next()
+		if err != nil {
+			return entries, err
+		}
+		if entry == nil {
+			return entries, nil
+		}
+		if entry.Time.Before(opts.Since) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func isSameFile(file *os.File, path string) bool {
+	var openStat, pathStat unix.Stat_t
+	if err := unix.Fstat(int(file.Fd()), &openStat); err != nil {
+		return false
+	}
+	if err := unix.Stat(path, &pathStat); err != nil {
+		return false
+	}
+
+	return openStat.Ino == pathStat.Ino && openStat.Dev == pathStat.Dev
+}
+
+func isContainerRunning(containerId string) bool {
+	container, err := state.Load(containerId)
+	if err != nil {
+		return false
+	}
+
+	return container.IsRunning()
+}
+
+func followEntries(containerId string, path string, file *os.File, reader *entryReader, opts *Options) {
+	for {
+		entry, err := reader.next()
+		if err != nil {
+			log.Fatalf("Failed to read log file %s: %v\n", path, err)
+		}
+		if entry != nil {
+			if !entry.Time.Before(opts.Since) {
+				printEntry(entry, opts)
+			}
+			continue
+		}
+
+		//Log file was rotated, rest of old file has been consumed, move to the new one
+		if !isSameFile(file, path) {
+			newFile, err := os.Open(path)
+			if err == nil {
+				file.Close()
+				file = newFile
+				reader = &entryReader{reader: bufio.NewReader(file)}
+				continue
+			}
+		}
+
+		if !isContainerRunning(containerId) {
+			file.Close()
+			return
+		}
+		time.Sleep(followInterval)
+	}
+}
+
+// readLogEntries reads entries of log file at path and its rotated files from the oldest one, and keeps
+// the last opts.Tail of them. Current file is returned open, so follow mode continues from where it stops
+func readLogEntries(path string, maxFile int, opts *Options) ([]*Entry, *os.File, *entryReader, error) {
+	var entries []*Entry
+	for n := maxFile - 1; n > 0; n-- {
+		file, err := os.Open(getRotatedPath(path, n))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, nil, nil, err
+		}
+		entries, err = readAllEntries(&entryReader{reader: bufio.NewReader(file)}, opts, entries)
+		file.Close()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	reader := &entryReader{reader: bufio.NewReader(file)}
+	if entries, err = readAllEntries(reader, opts, entries); err != nil {
+		file.Close()
+		return nil, nil, nil, err
+	}
+
+	if opts.Tail >= 0 && len(entries) > opts.Tail {
+		entries = entries[len(entries)-opts.Tail:]
+	}
+
+	return entries, file, reader, nil
+}
+
+// PrintContainerLogs prints captured output of a container, from the oldest rotated file to the current one
+func PrintContainerLogs(containerId string, opts Options) {
+	container, err := state.Load(containerId)
+	if err != nil {
+		log.Fatalf("Failed to find container %s: %v\n", containerId, err)
+	}
+	if container.Log.Path == "" {
+		log.Fatalf("No logs captured for container %s\n", containerId)
+	}
+
+	entries, file, reader, err := readLogEntries(container.Log.Path, container.Log.MaxFile, &opts)
+	if err != nil {
+		log.Fatalf("Failed to read log file: %v\n", err)
+	}
+	for _, entry := range entries {
+		printEntry(entry, &opts)
+	}
+
+	if opts.Follow {
+		followEntries(containerId, container.Log.Path, file, reader, &opts)
+		return
+	}
+	file.Close()
+}
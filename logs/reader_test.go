@@ -0,0 +1,44 @@
+package logs
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTailAcrossRotatedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "container-json.log")
+	//Leaves e3 e4 in path.2, e5 e6 in path.1 and e7 in path
+	writeTestLogs(t, path, 3, []string{"e1\n", "e2\n", "e3\n", "e4\n", "e5\n", "e6\n", "e7\n"})
+
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{"all", Options{Tail: -1}, []string{"e3\n", "e4\n", "e5\n", "e6\n", "e7\n"}},
+		{"current file only", Options{Tail: 1}, []string{"e7\n"}},
+		{"across rotated files", Options{Tail: 4}, []string{"e4\n", "e5\n", "e6\n", "e7\n"}},
+		{"more than captured", Options{Tail: 10}, []string{"e3\n", "e4\n", "e5\n", "e6\n", "e7\n"}},
+		{"none", Options{Tail: 0}, nil},
+		{"since after all entries", Options{Tail: -1, Since: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, file, _, err := readLogEntries(path, 3, &test.opts)
+			if err != nil {
+				t.Fatalf("readLogEntries failed: %v", err)
+			}
+			file.Close()
+
+			var got []string
+			for _, entry := range entries {
+				got = append(got, entry.Log)
+			}
+			if !equalLogs(got, test.want) {
+				t.Errorf("Got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
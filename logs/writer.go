@@ -0,0 +1,179 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// Entry is one line of container output, stored as one json line in log file
+type Entry struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// Writer appends entries of all streams of a container to a json-lines file,
+// rotating the file once it grows over max size
+type Writer struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	maxFile int
+	file    *os.File
+	size    int64
+}
+
+// ParseSize parses size like 500k, 10m or 1g into bytes
+func ParseSize(size string) (int64, error) {
+	size = strings.ToLower(strings.TrimSpace(size))
+	if size == "" || size == "-1" {
+		return -1, nil
+	}
+
+	units := map[string]int64{"k": 1024, "m": 1024 * 1024, "g": 1024 * 1024 * 1024}
+	multiplier := int64(1)
+	if unit, ok := units[size[len(size)-1:]]; ok {
+		multiplier = unit
+		size = size[:len(size)-1]
+	}
+
+	value, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid size %s", size)
+	}
+
+	return value * multiplier, nil
+}
+
+// NewWriter opens log file at path, maxSize <= 0 disables rotation
+func NewWriter(path string, maxSize int64, maxFile int) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if maxFile < 1 {
+		maxFile = 1
+	}
+
+	return &Writer{path: path, maxSize: maxSize, maxFile: maxFile, file: file, size: info.Size()}, nil
+}
+
+// getRotatedPath returns path of the n-th rotated file, 0 is the file being written
+func getRotatedPath(path string, n int) string {
+	if n == 0 {
+		return path
+	}
+
+	return path + "." + strconv.Itoa(n)
+}
+
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	//Shift path.N-1 -> path.N ... path -> path.1, the oldest one falls out
+	for n := w.maxFile - 1; n > 0; n-- {
+		if err := os.Rename(getRotatedPath(w.path, n-1), getRotatedPath(w.path, n)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if w.maxFile == 1 {
+		if err := os.Remove(w.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.size = 0
+
+	return nil
+}
+
+func (w *Writer) writeEntry(entry *Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(data)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.file.Write(data)
+	w.size += int64(n)
+
+	return err
+}
+
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.file.Close()
+}
+
+// Stream returns a writer which tags every line written to it with the stream name
+func (w *Writer) Stream(stream string) io.WriteCloser {
+	return &streamWriter{writer: w, stream: stream}
+}
+
+type streamWriter struct {
+	writer *Writer
+	stream string
+	buf    []byte
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	for {
+		idx := bytes.IndexByte(s.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		entry := &Entry{Log: string(s.buf[:idx+1]), Stream: s.stream, Time: time.Now().UTC()}
+		s.buf = s.buf[idx+1:]
+		if err := s.writer.writeEntry(entry); err != nil {
+			return len(p), err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Close flushes the last line which has no trailing newline
+func (s *streamWriter) Close() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	entry := &Entry{Log: string(s.buf), Stream: s.stream, Time: time.Now().UTC()}
+	s.buf = nil
+
+	return s.writer.writeEntry(entry)
+}
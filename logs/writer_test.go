@@ -0,0 +1,172 @@
+package logs
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    int64
+		wantErr bool
+	}{
+		{"", -1, false},
+		{"-1", -1, false},
+		{"100", 100, false},
+		{"500k", 500 * 1024, false},
+		{"10m", 10 * 1024 * 1024, false},
+		{"1G", 1024 * 1024 * 1024, false},
+		{" 2m ", 2 * 1024 * 1024, false},
+		{"0", 0, true},
+		{"-5", 0, true},
+		{"abc", 0, true},
+		{"5x", 0, true},
+		{"m", 0, true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseSize(test.size)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseSize(%q) = %d, want error", test.size, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", test.size, got, err, test.want)
+		}
+	}
+}
+
+// testEntry returns entry with a fixed time, so all entries of the same log length take the same size
+func testEntry(log string) *Entry {
+	return &Entry{Log: log, Stream: StreamStdout, Time: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+}
+
+func entrySize(t *testing.T, log string) int64 {
+	t.Helper()
+	data, err := json.Marshal(testEntry(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return int64(len(data)) + 1
+}
+
+// readLogs returns log field of every entry in file at path
+func readLogs(t *testing.T, path string) []string {
+	t.Helper()
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var logs []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := &Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			t.Fatalf("Invalid line %q in %s: %v", scanner.Text(), path, err)
+		}
+		logs = append(logs, entry.Log)
+	}
+
+	return logs
+}
+
+func equalLogs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeTestLogs writes entries with given logs into a writer rotating after exactly two entries
+func writeTestLogs(t *testing.T, path string, maxFile int, logs []string) {
+	t.Helper()
+	writer, err := NewWriter(path, 2*entrySize(t, "e1\n"), maxFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	for _, log := range logs {
+		if err := writer.writeEntry(testEntry(log)); err != nil {
+			t.Fatalf("writeEntry failed: %v", err)
+		}
+	}
+}
+
+func TestWriterRotatesAtSizeBoundary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "container-json.log")
+	writeTestLogs(t, path, 3, []string{"e1\n", "e2\n"})
+
+	//Two entries fill the file exactly, which is not over max size yet
+	if got := readLogs(t, path); !equalLogs(got, []string{"e1\n", "e2\n"}) {
+		t.Errorf("Log file has %q, want e1 and e2", got)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("Log file rotated before reaching max size")
+	}
+
+	writeTestLogs(t, path, 3, []string{"e3\n"})
+	if got := readLogs(t, path); !equalLogs(got, []string{"e3\n"}) {
+		t.Errorf("Log file has %q, want e3", got)
+	}
+	if got := readLogs(t, path+".1"); !equalLogs(got, []string{"e1\n", "e2\n"}) {
+		t.Errorf("Rotated file has %q, want e1 and e2", got)
+	}
+}
+
+func TestWriterDropsOldestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "container-json.log")
+	writeTestLogs(t, path, 3, []string{"e1\n", "e2\n", "e3\n", "e4\n", "e5\n", "e6\n", "e7\n"})
+
+	want := map[string][]string{
+		path:        {"e7\n"},
+		path + ".1": {"e5\n", "e6\n"},
+		path + ".2": {"e3\n", "e4\n"},
+		path + ".3": nil,
+	}
+	for file, logs := range want {
+		if got := readLogs(t, file); !equalLogs(got, logs) {
+			t.Errorf("%s has %q, want %q", filepath.Base(file), got, logs)
+		}
+	}
+}
+
+func TestWriterWithoutRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "container-json.log")
+	writer, err := NewWriter(path, -1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := writer.Stream(StreamStderr)
+	if _, err := stream.Write([]byte("first\nsec")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write([]byte("ond\nlast")); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	if got := readLogs(t, path); !equalLogs(got, []string{"first\n", "second\n", "last"}) {
+		t.Errorf("Log file has %q, want lines split on newline and the unterminated last one", got)
+	}
+}
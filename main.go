@@ -3,15 +3,228 @@ package main
 import (
 	"flag"
 	"fmt"
+	"go-docker/cgroups"
+	"go-docker/dns"
 	"go-docker/image"
+	"go-docker/logs"
 	"go-docker/network"
 	"go-docker/ps"
 	"go-docker/run"
+	"go-docker/state"
 	"go-docker/utils"
+	"go-docker/volume"
 	"log"
 	"os"
+	"time"
 )
 
+func registerResourceFlags(flags *flag.FlagSet) *cgroups.Resources {
+	res := cgroups.NewResources()
+	flags.IntVar(&res.MemoryMB, "mem", -1, "Max RAM to allow in MB")
+	flags.IntVar(&res.SwapMB, "swap", -1, "Max swap to allow in MB")
+	flags.IntVar(&res.Pids, "pids", -1, "Number of max processes to allow")
+	flags.Float64Var(&res.Cpus, "cpus", -1, "Number of CPU cores to allow to use")
+
+	return &res
+}
+
+// shapingFlags are network shaping flags as given on command line
+type shapingFlags struct {
+	rate  string
+	burst string
+	delay string
+	loss  string
+}
+
+func registerShapingFlags(flags *flag.FlagSet) *shapingFlags {
+	values := &shapingFlags{}
+	flags.StringVar(&values.rate, "net-rate", "", "Max rate of traffic to container like 1mbit or 100kbps, 0 for unlimited")
+	flags.StringVar(&values.burst, "net-burst", "", "Bytes allowed above net-rate at once like 32k, about 10ms of traffic by default")
+	flags.StringVar(&values.delay, "net-delay", "", "Delay added to traffic to container like 100ms")
+	flags.StringVar(&values.loss, "net-loss", "", "Percent of packets to container dropped like 1.5%")
+
+	return values
+}
+
+// parseShapingFlags sets shaping fields whose flags are given on command line, other fields are kept
+func parseShapingFlags(flags *flag.FlagSet, values *shapingFlags, shaping *state.Shaping) {
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "net-rate":
+			shaping.Rate, err = network.ParseRate(values.rate)
+		case "net-burst":
+			shaping.Burst = 0
+			if values.burst != "0" {
+				var burst int64
+				burst, err = logs.ParseSize(values.burst)
+				shaping.Burst = uint64(max(burst, 0))
+			}
+		case "net-delay":
+			shaping.Delay, err = time.ParseDuration(values.delay)
+			if err == nil && shaping.Delay < 0 {
+				err = fmt.Errorf("delay %s is negative", values.delay)
+			}
+		case "net-loss":
+			shaping.Loss, err = network.ParseLoss(values.loss)
+		}
+		if err != nil {
+			log.Fatalf("Invalid value of --%s: %v", f.Name, err)
+		}
+	})
+}
+
+// getContainerId resolves container name or ID prefix given on command line to full container ID
+func getContainerId(idOrName string) string {
+	container, err := state.Resolve(idOrName)
+	if err != nil {
+		log.Fatalf("Failed to find container %s: %v", idOrName, err)
+	}
+
+	return container.Id
+}
+
+func runVolumeCommand(args []string) {
+	if len(args) < 1 {
+		utils.ShowGuide()
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "create":
+		name := ""
+		if len(args) > 1 {
+			name = args[1]
+		}
+		vol, err := volume.Create(name)
+		if err != nil {
+			log.Fatalf("Failed to create volume: %v", err)
+		}
+		fmt.Println(vol.Name)
+	case "ls":
+		volume.PrintVolumes()
+	case "inspect", "rm":
+		if len(args) < 2 {
+			utils.ShowGuide()
+			os.Exit(1)
+		}
+		if args[0] == "inspect" {
+			volume.InspectVolume(args[1])
+		} else if err := volume.Remove(args[1]); err != nil {
+			log.Fatalf("Failed to remove volume: %v", err)
+		}
+	case "prune":
+		removed, err := volume.Prune()
+		for _, name := range removed {
+			fmt.Println(name)
+		}
+		if err != nil {
+			log.Fatalf("Failed to prune volumes: %v", err)
+		}
+	default:
+		utils.ShowGuide()
+		os.Exit(1)
+	}
+}
+
+func runNetworkCommand(args []string) {
+	if len(args) < 1 {
+		utils.ShowGuide()
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "create":
+		flags := flag.FlagSet{}
+		driver := flags.String("d", network.DriverBridge, "Driver of the network")
+		flags.StringVar(driver, "driver", network.DriverBridge, "Driver of the network, bridge, macvlan, ipvlan or cni")
+		parent := flags.String("parent", "", "Host interface of macvlan and ipvlan networks")
+		cniConfDir := flags.String("cni-conf-dir", "", "Directory of CNI config lists, "+utils.GetCNIConfPath()+" by default")
+		icc := flags.Bool("icc", true, "Allow containers on the bridge to reach each other, published ports are always reachable")
+		cniBinDir := flags.String("cni-bin-dir", "", "Directories of CNI plugins separated by colon, "+utils.GetCNIBinPath()+" by default")
+		subnet := flags.String("subnet", "", "Subnet in CIDR format, picked automatically if not given")
+		gateway := flags.String("gateway", "", "Gateway address, the first address of subnet by default")
+		enableIPv6 := flags.Bool("ipv6", false, "Enable IPv6 on the network")
+		subnetV6 := flags.String("subnet-v6", "", "IPv6 subnet in CIDR format, a random ULA /64 if not given")
+		gatewayV6 := flags.String("gateway-v6", "", "IPv6 gateway address, the first address of subnet by default")
+		if err := flags.Parse(args[1:]); err != nil || flags.NArg() < 1 {
+			utils.ShowGuide()
+			os.Exit(1)
+		}
+		nw, err := network.Create(flags.Arg(0), &network.CreateOptions{
+			Driver:     *driver,
+			Parent:     *parent,
+			CNIConfDir: *cniConfDir,
+			CNIBinDir:  *cniBinDir,
+			DisableICC: !*icc,
+			Subnet:     *subnet,
+			Gateway:    *gateway,
+			EnableIPv6: *enableIPv6,
+			SubnetV6:   *subnetV6,
+			GatewayV6:  *gatewayV6,
+		})
+		if err != nil {
+			log.Fatalf("Failed to create network: %v", err)
+		}
+		fmt.Println(nw.Id)
+	case "ls":
+		network.PrintNetworks()
+	case "inspect", "rm":
+		if len(args) < 2 {
+			utils.ShowGuide()
+			os.Exit(1)
+		}
+		if args[0] == "inspect" {
+			network.InspectNetwork(args[1])
+		} else if err := network.Remove(args[1]); err != nil {
+			log.Fatalf("Failed to remove network: %v", err)
+		}
+	case "connect":
+		flags := flag.FlagSet{}
+		ip := flags.String("ip", "", "IPv4 address of container in the network subnet")
+		ipv6 := flags.String("ip6", "", "IPv6 address of container in the network subnet")
+		aliases := utils.StringList{}
+		flags.Var(&aliases, "alias", "Extra name of container on the network")
+		if err := flags.Parse(args[1:]); err != nil || flags.NArg() < 2 {
+			utils.ShowGuide()
+			os.Exit(1)
+		}
+		run.ConnectContainer(getContainerId(flags.Arg(1)), flags.Arg(0), *ip, *ipv6, aliases)
+	case "disconnect":
+		if len(args) < 3 {
+			utils.ShowGuide()
+			os.Exit(1)
+		}
+		run.DisconnectContainer(getContainerId(args[2]), args[1])
+	case "prune":
+		flags := flag.FlagSet{}
+		dryRun := flags.Bool("dry-run", false, "Print what would be removed without removing it")
+		if err := flags.Parse(args[1:]); err != nil {
+			utils.ShowGuide()
+			os.Exit(1)
+		}
+		run.PruneNetwork(*dryRun)
+	default:
+		utils.ShowGuide()
+		os.Exit(1)
+	}
+}
+
+func runSystemCommand(args []string) {
+	if len(args) < 1 || args[0] != "reconcile" {
+		utils.ShowGuide()
+		os.Exit(1)
+	}
+
+	flags := flag.FlagSet{}
+	dryRun := flags.Bool("dry-run", false, "Print what would be removed without removing it")
+	if err := flags.Parse(args[1:]); err != nil {
+		utils.ShowGuide()
+		os.Exit(1)
+	}
+	run.ReconcileSystem(*dryRun)
+}
+
 func main() {
 	command := os.Args[1]
 	if len(os.Args) < 2 || !utils.ValidCommand(command) {
@@ -32,35 +245,89 @@ func main() {
 	switch command {
 	case "run":
 		flags := flag.FlagSet{}
-		mem := flags.Int("mem", -1, "Max RAM to allow in MB")
-		swap := flags.Int("swap", -1, "Max swap to allow in MB")
-		pids := flags.Int("pids", -1, "Number of max processes to allow")
-		cpus := flags.Float64("cpus", -1, "Number of CPU cores to allow to use")
+		res := registerResourceFlags(&flags)
+		detach := flags.Bool("d", false, "Run container in background and print container ID")
+		useInit := flags.Bool("init", true, "Run an init inside the container that reaps zombies and relays signals")
+		logMaxSize := flags.String("log-max-size", "10m", "Max size of container log file before rotation, -1 for unlimited")
+		logMaxFile := flags.Int("log-max-file", 3, "Max number of container log files to keep")
+		name := flags.String("name", "", "Assign a name to the container")
+		envs := utils.StringList{}
+		flags.Var(&envs, "e", "Set environment variable KEY=VAL, or KEY to take value from host")
+		flags.Var(&envs, "env", "Set environment variable KEY=VAL, or KEY to take value from host")
+		envFiles := utils.StringList{}
+		flags.Var(&envFiles, "env-file", "Read environment variables from a file")
+		var workdir, user, hostname string
+		flags.StringVar(&workdir, "w", "", "Working directory inside the container")
+		flags.StringVar(&workdir, "workdir", "", "Working directory inside the container")
+		flags.StringVar(&user, "u", "", "User to run command as, uid[:gid] or name[:group]")
+		flags.StringVar(&user, "user", "", "User to run command as, uid[:gid] or name[:group]")
+		flags.StringVar(&hostname, "h", "", "Hostname of the container")
+		flags.StringVar(&hostname, "hostname", "", "Hostname of the container")
+		volumes := utils.StringList{}
+		flags.Var(&volumes, "v", "Bind mount host-path:container-path[:ro], or mount volume name:container-path[:ro]")
+		mounts := utils.StringList{}
+		flags.Var(&mounts, "mount", "Mount type=bind|volume,source=...,target=...[,readonly]")
+		ports := utils.StringList{}
+		flags.Var(&ports, "p", "Publish container port to host [hostIP:]hostPort:containerPort[/tcp|udp]")
+		ip := flags.String("ip", "", "IPv4 address of container in the network subnet")
+		ipv6 := flags.String("ip6", "", "IPv6 address of container in the network subnet")
+		aliases := utils.StringList{}
+		flags.Var(&aliases, "network-alias", "Extra name of container on the network")
+		dnsServers := utils.StringList{}
+		flags.Var(&dnsServers, "dns", "DNS server of container")
+		dnsSearch := utils.StringList{}
+		flags.Var(&dnsSearch, "dns-search", "DNS search domain of container")
+		dnsOptions := utils.StringList{}
+		flags.Var(&dnsOptions, "dns-option", "DNS resolver option of container")
+		extraHosts := utils.StringList{}
+		flags.Var(&extraHosts, "add-host", "Add name:ip to hosts file of container")
+		networkName := flags.String("network", network.DefaultNetworkName, "Network the container is connected to, or none, host, container:<id>")
+		shaping := registerShapingFlags(&flags)
+		egressAllow := utils.StringList{}
+		flags.Var(&egressAllow, "egress-allow", "Only allow traffic from container to cidr[:port[/tcp|udp]], can be given multiple times")
 
 		if err := flags.Parse(os.Args[2:]); err != nil {
 			fmt.Println("Error parsing input parameters: ", err)
 		}
-		if len(flags.Args()) < 2 {
+		if len(flags.Args()) < 1 {
 			log.Fatal("Please pass image name and command to run")
 		}
 
-		//Create network bridge br0 required in tool
-		if isOn, _ := network.IsDockerBridgeUp(); !isOn {
-			log.Printf("Setup and turn on the default network bridge...")
-			if err := network.SetupNetworkBridge(); err != nil {
-				log.Fatalf("Failed to create default network bridge: %v", err)
-			}
+		maxSize, err := logs.ParseSize(*logMaxSize)
+		if err != nil {
+			log.Fatalf("Invalid log max size: %v", err)
+		}
+		opts := &run.Options{
+			Resources:   *res,
+			Detach:      *detach,
+			Init:        *useInit,
+			LogMaxSize:  maxSize,
+			LogMaxFile:  *logMaxFile,
+			Name:        *name,
+			Env:         envs,
+			EnvFiles:    envFiles,
+			WorkingDir:  workdir,
+			User:        user,
+			Hostname:    hostname,
+			Volumes:     volumes,
+			Mounts:      mounts,
+			Ports:       ports,
+			IP:          *ip,
+			IPv6:        *ipv6,
+			Network:     *networkName,
+			Aliases:     aliases,
+			ExtraHosts:  extraHosts,
+			EgressAllow: egressAllow,
+			DNS:         state.DNSConfig{Servers: dnsServers, Search: dnsSearch, Options: dnsOptions},
 		}
+		parseShapingFlags(&flags, shaping, &opts.Shaping)
 
 		//Initialize the container based on inputs
-		run.InitContainer(*mem, *swap, *pids, *cpus, flags.Args()[0], flags.Args()[1:])
+		run.InitContainer(opts, flags.Args()[0], flags.Args()[1:])
 	case "inner-mode":
 		//Inside container mode, to run command inside container
 		flags := flag.FlagSet{}
-		mem := flags.Int("mem", -1, "Max RAM to allow in MB")
-		swap := flags.Int("swap", -1, "Max swap to allow in MB")
-		pids := flags.Int("pids", -1, "Number of max processes to allow")
-		cpus := flags.Float64("cpus", -1, "Number of CPU cores to allow to use")
+		useInit := flags.Bool("init", true, "Run as init of the container")
 
 		if err := flags.Parse(os.Args[2:]); err != nil {
 			fmt.Printf("Failed to parse input flags: %v\n", err)
@@ -68,15 +335,123 @@ func main() {
 		if len(flags.Args()) < 2 {
 			log.Fatalln("Need image name and command to run inside container")
 		}
-		run.SetupContainerExecCommand(*mem, *swap, *pids, *cpus, flags.Args()[0], flags.Args()[1:])
+		run.SetupContainerExecCommand(*useInit, flags.Args()[0], flags.Args()[1:])
+	case "shim":
+		//Supervisor process of detached container
+		run.RunContainerShim(os.Args[2])
+	case "dns-server":
+		dns.RunServer(os.Args[2])
+	case "port-proxy":
+		//Userland proxy of a published port
+		network.RunPortProxy(os.Args[2], os.Args[3])
 	case "ps":
 		ps.PrintRunningContainers()
+	case "stats":
+		var containerIds []string
+		for _, idOrName := range os.Args[2:] {
+			containerIds = append(containerIds, getContainerId(idOrName))
+		}
+		ps.PrintContainerStats(containerIds)
 	case "setup-netns":
 		network.SetupNewNetworkNamespace(os.Args[2])
 	case "setup-veth":
-		network.SetupContainerNetworkInterface(os.Args[2])
+		//Arguments: container ID, veth, address, gateway, IPv6 address, IPv6 gateway, empty if not used
+		if len(os.Args) < 8 {
+			log.Fatalf("Missing arguments of setup-veth")
+		}
+		network.SetupContainerNetworkInterface(os.Args[2], os.Args[3], os.Args[4], os.Args[5], os.Args[6], os.Args[7])
 	case "exec":
-		run.ExecCommandInContainer(os.Args[2])
+		if len(os.Args) < 4 {
+			utils.ShowGuide()
+			os.Exit(1)
+		}
+		run.ExecCommandInContainer(getContainerId(os.Args[2]), os.Args[3:])
+	case "inspect":
+		if len(os.Args) < 3 {
+			utils.ShowGuide()
+			os.Exit(1)
+		}
+		ps.InspectContainer(getContainerId(os.Args[2]))
+	case "logs":
+		flags := flag.FlagSet{}
+		follow := flags.Bool("f", false, "Follow log output")
+		since := flags.String("since", "", "Show logs since timestamp or relative time like 10m")
+		tail := flags.Int("tail", -1, "Number of lines to show from the end of the logs")
+		timestamps := flags.Bool("timestamps", false, "Show timestamps")
+
+		if err := flags.Parse(os.Args[2:]); err != nil {
+			fmt.Println("Error parsing input parameters: ", err)
+		}
+		if len(flags.Args()) < 1 {
+			utils.ShowGuide()
+			os.Exit(1)
+		}
+		sinceTime, err := logs.ParseSince(*since)
+		if err != nil {
+			log.Fatalf("Invalid since value: %v", err)
+		}
+		logs.PrintContainerLogs(getContainerId(flags.Args()[0]), logs.Options{
+			Follow:     *follow,
+			Since:      sinceTime,
+			Tail:       *tail,
+			Timestamps: *timestamps,
+		})
+	case "stop", "restart":
+		flags := flag.FlagSet{}
+		timeout := flags.Int("t", run.DefaultStopTimeout, "Seconds to wait for container to stop before killing it")
+
+		if err := flags.Parse(os.Args[2:]); err != nil {
+			fmt.Println("Error parsing input parameters: ", err)
+		}
+		if len(flags.Args()) < 1 {
+			utils.ShowGuide()
+			os.Exit(1)
+		}
+		if command == "stop" {
+			run.StopContainer(getContainerId(flags.Args()[0]), *timeout)
+		} else {
+			run.RestartContainer(getContainerId(flags.Args()[0]), *timeout)
+		}
+	case "kill":
+		flags := flag.FlagSet{}
+		signalName := flags.String("s", "KILL", "Signal to send to the container")
+
+		if err := flags.Parse(os.Args[2:]); err != nil {
+			fmt.Println("Error parsing input parameters: ", err)
+		}
+		if len(flags.Args()) < 1 {
+			utils.ShowGuide()
+			os.Exit(1)
+		}
+		sig, err := run.ParseSignal(*signalName)
+		if err != nil {
+			log.Fatalf("Invalid signal: %v", err)
+		}
+		run.KillContainer(getContainerId(flags.Args()[0]), sig)
+	case "update":
+		flags := flag.FlagSet{}
+		shaping := registerShapingFlags(&flags)
+
+		if err := flags.Parse(os.Args[2:]); err != nil {
+			fmt.Println("Error parsing input parameters: ", err)
+		}
+		if len(flags.Args()) < 1 {
+			utils.ShowGuide()
+			os.Exit(1)
+		}
+		container, err := state.Resolve(flags.Args()[0])
+		if err != nil {
+			log.Fatalf("Failed to find container %s: %v", flags.Args()[0], err)
+		}
+		newShaping := container.Network.Shaping
+		parseShapingFlags(&flags, shaping, &newShaping)
+		run.UpdateNetworkShaping(container.Id, newShaping)
+	case "volume":
+		runVolumeCommand(os.Args[2:])
+	case "network":
+		runNetworkCommand(os.Args[2:])
+	case "system":
+		runSystemCommand(os.Args[2:])
 	case "images":
 		image.PrintImages()
 	case "clean":
@@ -84,7 +459,7 @@ func main() {
 			utils.ShowGuide()
 			os.Exit(1)
 		}
-		run.CleanUpContainer(os.Args[2])
+		run.CleanUpContainer(getContainerId(os.Args[2]))
 	case "rmImage":
 		if len(os.Args) < 3 {
 			utils.ShowGuide()
@@ -0,0 +1,221 @@
+package network
+
+import (
+	"fmt"
+	"go-docker/dns"
+	"go-docker/state"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Prefix of comments tagging isolation rules of bridges
+const isolationRuleCommentPrefix = "go-docker:isolation:"
+
+func getIsolationRuleComment(bridge string) string {
+	return isolationRuleCommentPrefix + bridge
+}
+
+// Prefix of comments tagging rules blocking traffic between containers on a bridge
+const iccRuleCommentPrefix = "go-docker:icc:"
+
+func getICCRuleComment(bridge string) string {
+	return iccRuleCommentPrefix + bridge
+}
+
+// Settings of br_netfilter passing bridged traffic through netfilter hooks of IP
+var bridgeNetfilterPaths = []string{
+	"/proc/sys/net/bridge/bridge-nf-call-iptables",
+	"/proc/sys/net/bridge/bridge-nf-call-ip6tables",
+}
+
+func isBridgeUp(name string) (bool, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		log.Printf("Failed to get list of network links\n")
+		return false, err
+	}
+	for _, link := range links {
+		if link.Type() == "bridge" && link.Attrs().Name == name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func setupNetworkBridge(name string, subnet *net.IPNet, gateway net.IP, subnetV6 *net.IPNet, gatewayV6 net.IP) error {
+	linkAttrs := netlink.NewLinkAttrs()
+	linkAttrs.Name = name
+	dockerBridge := &netlink.Bridge{LinkAttrs: linkAttrs}
+
+	if err := netlink.LinkAdd(dockerBridge); err != nil {
+		return err
+	}
+
+	address := &netlink.Addr{IPNet: &net.IPNet{IP: gateway, Mask: subnet.Mask}}
+	if err := netlink.AddrAdd(dockerBridge, address); err != nil {
+		return err
+	}
+	if subnetV6 != nil {
+		//Skip duplicate address detection, so the gateway can be used at once
+		address = &netlink.Addr{IPNet: &net.IPNet{IP: gatewayV6, Mask: subnetV6.Mask}, Flags: unix.IFA_F_NODAD}
+		if err := netlink.AddrAdd(dockerBridge, address); err != nil {
+			return err
+		}
+	}
+	return netlink.LinkSetUp(dockerBridge)
+}
+
+// setupBridgeIsolation drops traffic forwarded from the bridge to bridges of other networks,
+// bridges of all networks are kept in set bridges of go-docker table
+func setupBridgeIsolation(bridge string) error {
+	if err := addFirewallSetElement("bridges", "\""+bridge+"\""); err != nil {
+		return err
+	}
+
+	comment := getIsolationRuleComment(bridge)
+	if hasFirewallRules(comment) {
+		return nil
+	}
+
+	rule := fmt.Sprintf("iifname \"%s\" oifname @bridges oifname != \"%s\" drop", bridge, bridge)
+	return addFirewallRules("forward", comment, rule)
+}
+
+func teardownBridgeIsolation(bridge string) error {
+	if err := deleteFirewallRules(getIsolationRuleComment(bridge)); err != nil {
+		return err
+	}
+
+	return deleteFirewallSetElement("bridges", "\""+bridge+"\"")
+}
+
+// enableBridgeNetfilter loads br_netfilter, without which traffic between ports of one bridge never
+// reaches forward chain. Like Docker it is kept on, as other bridges may rely on it once enabled
+func enableBridgeNetfilter() error {
+	if _, err := os.Stat(bridgeNetfilterPaths[0]); os.IsNotExist(err) {
+		if output, err := exec.Command("modprobe", "br_netfilter").CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to load br_netfilter: %v: %s", err, strings.TrimSpace(string(output)))
+		}
+	}
+	for _, path := range bridgeNetfilterPaths {
+		if err := os.WriteFile(path, []byte("1"), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setupBridgeICC drops traffic between containers on the bridge, except traffic to published ports
+// of other containers which is DNATed by publish chain
+func setupBridgeICC(bridge string) error {
+	if err := enableBridgeNetfilter(); err != nil {
+		return err
+	}
+
+	comment := getICCRuleComment(bridge)
+	if hasFirewallRules(comment) {
+		return nil
+	}
+
+	return addFirewallRules("forward", comment,
+		fmt.Sprintf("iifname \"%s\" oifname \"%s\" ct status dnat accept", bridge, bridge),
+		fmt.Sprintf("iifname \"%s\" oifname \"%s\" drop", bridge, bridge),
+	)
+}
+
+// SetupBridge makes the bridge of network ready for containers: it creates the bridge with gateway address
+// if it doesn't exist, installs NAT, isolation and ICC rules and starts DNS server. Calling it again changes nothing
+func SetupBridge(nw *Network) error {
+	subnet, gateway, err := nw.GetSubnet()
+	if err != nil {
+		return err
+	}
+	subnetV6, gatewayV6, err := nw.GetSubnetV6()
+	if err != nil {
+		return err
+	}
+
+	isOn, err := isBridgeUp(nw.Bridge)
+	if err != nil {
+		return err
+	}
+	if !isOn {
+		log.Printf("Setup and turn on network bridge %s...", nw.Bridge)
+		if err := setupNetworkBridge(nw.Bridge, subnet, gateway, subnetV6, gatewayV6); err != nil {
+			return fmt.Errorf("failed to create bridge %s: %w", nw.Bridge, err)
+		}
+	}
+
+	if err := SetupBridgeNAT(nw.Bridge, subnet, subnetV6); err != nil {
+		return err
+	}
+	if err := setupBridgeIsolation(nw.Bridge); err != nil {
+		return err
+	}
+	if nw.DisableICC {
+		if err := setupBridgeICC(nw.Bridge); err != nil {
+			return err
+		}
+	}
+
+	//Like Docker, containers on the default network use resolvers of host and can't resolve each other
+	if nw.Name == DefaultNetworkName {
+		return nil
+	}
+	return dns.EnsureServer(nw.Name, nw.Gateway)
+}
+
+// TeardownBridge removes the bridge of network with its DNS server, NAT, isolation and ICC rules
+func TeardownBridge(nw *Network) error {
+	if err := dns.StopServer(nw.Name); err != nil {
+		return err
+	}
+	if err := teardownBridgeIsolation(nw.Bridge); err != nil {
+		return err
+	}
+	if err := deleteFirewallRules(getICCRuleComment(nw.Bridge)); err != nil {
+		return err
+	}
+	if err := TeardownBridgeNAT(nw.Bridge); err != nil {
+		return err
+	}
+
+	link, err := netlink.LinkByName(nw.Bridge)
+	if err != nil {
+		//Bridge was never created or is gone after reboot
+		return nil
+	}
+
+	return netlink.LinkDel(link)
+}
+
+// bridgeDriver attaches containers to a Linux bridge of host with veth pairs, host is gateway of the network
+type bridgeDriver struct{}
+
+func (d *bridgeDriver) Setup(nw *Network) error {
+	return SetupBridge(nw)
+}
+
+func (d *bridgeDriver) Teardown(nw *Network) error {
+	return TeardownBridge(nw)
+}
+
+func (d *bridgeDriver) CreateEndpoint(nw *Network, endpoint *state.Endpoint) error {
+	return SetupVirtualEthOnHost(endpoint, nw.Bridge)
+}
+
+func (d *bridgeDriver) DeleteEndpoint(containerId string, endpoint *state.Endpoint) error {
+	return DeleteVirtualEth(endpoint.HostVeth)
+}
+
+func (d *bridgeDriver) HostIsGateway() bool {
+	return true
+}
@@ -0,0 +1,338 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go-docker/state"
+	"go-docker/utils"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const DriverCNI = "cni"
+
+// Config file extensions read from CNI config directory, .conf and .json hold a single plugin
+var cniConfExtensions = []string{".conflist", ".conf", ".json"}
+
+// cniConfList is a network config list of CNI spec, plugins are kept raw as each one has its own fields
+type cniConfList struct {
+	CNIVersion string            `json:"cniVersion"`
+	Name       string            `json:"name"`
+	Plugins    []json.RawMessage `json:"plugins"`
+}
+
+// cniError is the error printed to stdout by a failed plugin
+type cniError struct {
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+	Details string `json:"details"`
+}
+
+// cniResult holds what go-docker uses from result of ADD, ip4 and ip6 are results of spec before 0.3.0
+type cniResult struct {
+	Interfaces []struct {
+		Name    string `json:"name"`
+		Mac     string `json:"mac"`
+		Sandbox string `json:"sandbox"`
+	} `json:"interfaces"`
+	IPs []struct {
+		Address   string `json:"address"`
+		Gateway   string `json:"gateway"`
+		Interface *int   `json:"interface"`
+	} `json:"ips"`
+	IP4 *struct {
+		IP      string `json:"ip"`
+		Gateway string `json:"gateway"`
+	} `json:"ip4"`
+	IP6 *struct {
+		IP      string `json:"ip"`
+		Gateway string `json:"gateway"`
+	} `json:"ip6"`
+}
+
+func getCNIResultPath(containerId string, ifName string) string {
+	return utils.GetDockerNetworkPath() + "/cni/" + containerId + "-" + ifName + ".json"
+}
+
+func (nw *Network) getCNIConfDir() string {
+	if nw.CNIConfDir != "" {
+		return nw.CNIConfDir
+	}
+	return utils.GetCNIConfPath()
+}
+
+func (nw *Network) getCNIBinDir() string {
+	if nw.CNIBinDir != "" {
+		return nw.CNIBinDir
+	}
+	return utils.GetCNIBinPath()
+}
+
+// loadCNIConfList finds config of CNI network by its name in config directory, files are tried
+// in lexical order like other CNI runtimes
+func loadCNIConfList(confDir string, name string) (*cniConfList, error) {
+	entries, err := os.ReadDir(confDir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		for _, ext := range cniConfExtensions {
+			if !entry.IsDir() && filepath.Ext(entry.Name()) == ext {
+				files = append(files, filepath.Join(confDir, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		conf := &cniConfList{}
+		if err := json.Unmarshal(data, conf); err != nil {
+			return nil, fmt.Errorf("failed to parse CNI config %s: %w", file, err)
+		}
+		if conf.Name != name {
+			continue
+		}
+		//A single plugin config is a list of itself
+		if filepath.Ext(file) != ".conflist" {
+			conf.Plugins = []json.RawMessage{data}
+		}
+		if len(conf.Plugins) == 0 {
+			return nil, fmt.Errorf("CNI config %s has no plugins", file)
+		}
+		return conf, nil
+	}
+
+	return nil, fmt.Errorf("no CNI config of network %s in %s", name, confDir)
+}
+
+// getPluginConfig returns config passed to one plugin of the list, with name and version of the list
+// and result of the previous plugin
+func getPluginConfig(conf *cniConfList, plugin json.RawMessage, prevResult json.RawMessage) (string, []byte, error) {
+	pluginConf := map[string]interface{}{}
+	if err := json.Unmarshal(plugin, &pluginConf); err != nil {
+		return "", nil, err
+	}
+	pluginType, _ := pluginConf["type"].(string)
+	if pluginType == "" || strings.Contains(pluginType, "/") {
+		return "", nil, fmt.Errorf("invalid plugin type %q in CNI config %s", pluginType, conf.Name)
+	}
+
+	pluginConf["name"] = conf.Name
+	pluginConf["cniVersion"] = conf.CNIVersion
+	delete(pluginConf, "prevResult")
+	if prevResult != nil {
+		pluginConf["prevResult"] = prevResult
+	}
+	data, err := json.Marshal(pluginConf)
+
+	return pluginType, data, err
+}
+
+// execPlugin runs a plugin binary with CNI environment variables and its config on stdin, it returns stdout
+func execPlugin(nw *Network, pluginType string, command string, containerId string, netnsPath string, ifName string, config []byte) ([]byte, error) {
+	binDirs := filepath.SplitList(nw.getCNIBinDir())
+	pluginPath := ""
+	for _, dir := range binDirs {
+		if _, err := os.Stat(filepath.Join(dir, pluginType)); err == nil {
+			pluginPath = filepath.Join(dir, pluginType)
+			break
+		}
+	}
+	if pluginPath == "" {
+		return nil, fmt.Errorf("CNI plugin %s not found in %s", pluginType, nw.getCNIBinDir())
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(pluginPath)
+	cmd.Env = append(os.Environ(),
+		"CNI_COMMAND="+command,
+		"CNI_CONTAINERID="+containerId,
+		"CNI_NETNS="+netnsPath,
+		"CNI_IFNAME="+ifName,
+		"CNI_PATH="+nw.getCNIBinDir(),
+	)
+	cmd.Stdin = bytes.NewReader(config)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		pluginErr := &cniError{}
+		if json.Unmarshal(stdout.Bytes(), pluginErr) == nil && pluginErr.Msg != "" {
+			return nil, fmt.Errorf("CNI plugin %s failed with code %d: %s %s", pluginType, pluginErr.Code, pluginErr.Msg, pluginErr.Details)
+		}
+		return nil, fmt.Errorf("CNI plugin %s failed: %w %s", pluginType, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// setEndpointAddresses copies addresses of the container interface in result of ADD into endpoint
+func setEndpointAddresses(endpoint *state.Endpoint, data []byte) error {
+	result := &cniResult{}
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("failed to parse CNI result: %w", err)
+	}
+
+	setAddress := func(address string, gateway string) {
+		ip, subnet, err := net.ParseCIDR(address)
+		if err != nil {
+			return
+		}
+		prefixLen, _ := subnet.Mask.Size()
+		if ip.To4() != nil && endpoint.IPAddress == "" {
+			endpoint.IPAddress, endpoint.PrefixLen, endpoint.Gateway = ip.String(), prefixLen, gateway
+		} else if ip.To4() == nil && endpoint.IPv6Address == "" {
+			endpoint.IPv6Address, endpoint.PrefixLenV6, endpoint.GatewayV6 = ip.String(), prefixLen, gateway
+		}
+	}
+
+	for i, iface := range result.Interfaces {
+		if iface.Sandbox == "" || iface.Name != endpoint.ContainerVeth {
+			continue
+		}
+		endpoint.MacAddress = iface.Mac
+		for _, ip := range result.IPs {
+			if ip.Interface != nil && *ip.Interface == i {
+				setAddress(ip.Address, ip.Gateway)
+			}
+		}
+	}
+	//Plugins may not tell which interface an address belongs to
+	for _, ip := range result.IPs {
+		if ip.Interface == nil {
+			setAddress(ip.Address, ip.Gateway)
+		}
+	}
+	if result.IP4 != nil {
+		setAddress(result.IP4.IP, result.IP4.Gateway)
+	}
+	if result.IP6 != nil {
+		setAddress(result.IP6.IP, result.IP6.Gateway)
+	}
+
+	return nil
+}
+
+// deleteCNIEndpoint runs DEL of plugins in reverse order, with the cached result of ADD as previous result
+func deleteCNIEndpoint(nw *Network, containerId string, netnsPath string, endpoint *state.Endpoint) error {
+	conf, err := loadCNIConfList(nw.getCNIConfDir(), nw.Name)
+	if err != nil {
+		return err
+	}
+	resultPath := getCNIResultPath(containerId, endpoint.ContainerVeth)
+	//Result is missing if ADD failed half way
+	prevResult, _ := os.ReadFile(resultPath)
+
+	err = deletePlugins(nw, conf, conf.Plugins, containerId, netnsPath, endpoint.ContainerVeth, prevResult)
+	os.Remove(resultPath)
+
+	return err
+}
+
+// deletePlugins runs DEL of plugins in reverse order, all of them are run even if some fail
+func deletePlugins(nw *Network, conf *cniConfList, plugins []json.RawMessage, containerId string, netnsPath string, ifName string, prevResult []byte) error {
+	var errs []string
+	for i := len(plugins) - 1; i >= 0; i-- {
+		pluginType, config, err := getPluginConfig(conf, plugins[i], prevResult)
+		if err == nil {
+			_, err = execPlugin(nw, pluginType, "DEL", containerId, netnsPath, ifName, config)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// AddCNIEndpoint runs ADD of plugins of CNI network in order against network namespace of the container,
+// and fills addresses of endpoint from the final result. Plugins already added are deleted if one fails
+func AddCNIEndpoint(nw *Network, containerId string, endpoint *state.Endpoint) error {
+	conf, err := loadCNIConfList(nw.getCNIConfDir(), nw.Name)
+	if err != nil {
+		return err
+	}
+	netnsPath := utils.GetDockerNetNsPath() + "/" + containerId
+
+	var result json.RawMessage
+	for i, plugin := range conf.Plugins {
+		var output []byte
+		pluginType, config, err := getPluginConfig(conf, plugin, result)
+		if err == nil {
+			output, err = execPlugin(nw, pluginType, "ADD", containerId, netnsPath, endpoint.ContainerVeth, config)
+		}
+		if err != nil {
+			//Roll back plugins added so far with the last result they built. DEL of the failed plugin is
+			//run too, it may have set up part of its work before failing and DEL tolerates missing state
+			if delErr := deletePlugins(nw, conf, conf.Plugins[:i+1], containerId, netnsPath, endpoint.ContainerVeth, result); delErr != nil {
+				log.Printf("Failed to roll back CNI plugins of network %s: %v\n", nw.Name, delErr)
+			}
+			return err
+		}
+		result = output
+	}
+
+	//DEL needs the result later, plugins can't be left added without it
+	err = os.MkdirAll(filepath.Dir(getCNIResultPath(containerId, endpoint.ContainerVeth)), utils.File_OtherReadExecute)
+	if err == nil {
+		err = os.WriteFile(getCNIResultPath(containerId, endpoint.ContainerVeth), result, utils.File_OtherReadOnly)
+	}
+	if err == nil {
+		err = setEndpointAddresses(endpoint, result)
+	}
+	if err != nil {
+		deleteCNIEndpoint(nw, containerId, netnsPath, endpoint)
+		return err
+	}
+
+	return nil
+}
+
+// cniDriver delegates setup of container interfaces to CNI plugins, network name is the name of a config
+// list in CNI config directory. Plugins are added when network namespace of container is created
+type cniDriver struct{}
+
+func (d *cniDriver) Setup(nw *Network) error {
+	_, err := loadCNIConfList(nw.getCNIConfDir(), nw.Name)
+	return err
+}
+
+func (d *cniDriver) Teardown(nw *Network) error {
+	return nil
+}
+
+func (d *cniDriver) CreateEndpoint(nw *Network, endpoint *state.Endpoint) error {
+	endpoint.HostVeth = ""
+	return nil
+}
+
+func (d *cniDriver) DeleteEndpoint(containerId string, endpoint *state.Endpoint) error {
+	nw, err := Get(endpoint.NetworkId)
+	if err != nil {
+		return err
+	}
+	netnsPath := utils.GetDockerNetNsPath() + "/" + containerId
+	if _, err := os.Stat(netnsPath); err != nil {
+		//DEL is still called to release what plugins hold outside the namespace, like addresses
+		netnsPath = ""
+	}
+
+	return deleteCNIEndpoint(nw, containerId, netnsPath, endpoint)
+}
+
+func (d *cniDriver) HostIsGateway() bool {
+	return false
+}
@@ -0,0 +1,66 @@
+package network
+
+import (
+	"go-docker/state"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Fake plugin logs its command, name and the plugin which built its previous result. Its own result
+// tells it was built by it, plugin named fail fails ADD
+const fakeCNIPlugin = `#!/bin/sh
+name=$(basename "$0")
+prev=$(grep -o 'built-by-[a-z]*' | head -n 1)
+echo "$CNI_COMMAND $name $prev" >> "$(dirname "$0")/calls.log"
+if [ "$CNI_COMMAND" = ADD ] && [ "$name" = fail ]; then
+	echo '{"code": 11, "msg": "fail on purpose"}'
+	exit 1
+fi
+echo '{"cniVersion": "1.0.0", "dns": {"domain": "built-by-'$name'"}}'
+`
+
+func TestAddCNIEndpointRollsBack(t *testing.T) {
+	confDir, binDir := t.TempDir(), t.TempDir()
+	for _, name := range []string{"first", "second", "fail", "never"} {
+		if err := os.WriteFile(filepath.Join(binDir, name), []byte(fakeCNIPlugin), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := `{"cniVersion": "1.0.0", "name": "test", "plugins": [
+		{"type": "first"}, {"type": "second"}, {"type": "fail"}, {"type": "never"}
+	]}`
+	if err := os.WriteFile(filepath.Join(confDir, "10-test.conflist"), []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	nw := &Network{Name: "test", Driver: DriverCNI, CNIConfDir: confDir, CNIBinDir: binDir}
+	endpoint := &state.Endpoint{ContainerVeth: "veth1_012345"}
+	if err := AddCNIEndpoint(nw, "0123456789ab", endpoint); err == nil || !strings.Contains(err.Error(), "fail on purpose") {
+		t.Fatalf("AddCNIEndpoint = %v, want error of failed plugin", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(binDir, "calls.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Plugins added before the failure, and the failed one, are deleted in reverse order with the last result
+	want := []string{
+		"ADD first ",
+		"ADD second built-by-first",
+		"ADD fail built-by-second",
+		"DEL fail built-by-second",
+		"DEL second built-by-second",
+		"DEL first built-by-second",
+	}
+	got := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(got) != len(want) {
+		t.Fatalf("Plugin calls %q, want %q", got, want)
+	}
+	for i := range want {
+		if strings.TrimSpace(got[i]) != strings.TrimSpace(want[i]) {
+			t.Errorf("Plugin call %d is %q, want %q", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package network
+
+import (
+	"fmt"
+	"go-docker/state"
+)
+
+const (
+	DriverBridge  = "bridge"
+	DriverMacvlan = "macvlan"
+	DriverIPvlan  = "ipvlan"
+)
+
+// Driver creates networks of one type and attaches containers to them, so callers don't care how
+// the link of a container is made
+type Driver interface {
+	// Setup makes the network ready for containers, calling it again changes nothing
+	Setup(nw *Network) error
+	// Teardown removes what Setup created on host
+	Teardown(nw *Network) error
+	// CreateEndpoint creates links of the endpoint on host, ContainerVeth of endpoint is moved into the container later
+	CreateEndpoint(nw *Network, endpoint *state.Endpoint) error
+	// DeleteEndpoint removes links of the endpoint, from network namespace of the container if they were moved there
+	DeleteEndpoint(containerId string, endpoint *state.Endpoint) error
+	// HostIsGateway tells if traffic of containers goes through host, which is needed to publish ports,
+	// shape traffic and serve DNS on the gateway
+	HostIsGateway() bool
+}
+
+// GetDriver returns driver of the given type
+func GetDriver(driver string) (Driver, error) {
+	switch driver {
+	case DriverBridge:
+		return &bridgeDriver{}, nil
+	case DriverMacvlan:
+		return &macvlanDriver{}, nil
+	case DriverIPvlan:
+		return &ipvlanDriver{}, nil
+	case DriverCNI:
+		return &cniDriver{}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported network driver %s", driver)
+}
+
+// GetDriver returns driver of the network
+func (nw *Network) GetDriver() (Driver, error) {
+	return GetDriver(nw.Driver)
+}
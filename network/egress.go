@@ -0,0 +1,199 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Prefix of comments tagging egress rules of containers
+const egressRuleCommentPrefix = "go-docker:egress:"
+
+func getEgressRuleComment(containerId string) string {
+	return egressRuleCommentPrefix + containerId
+}
+
+// EgressRule is one entry of the egress allow-list of a container, port 0 allows all ports
+// and empty protocol allows both tcp and udp
+type EgressRule struct {
+	Subnet   *net.IPNet
+	Port     int
+	Protocol string
+}
+
+// parseEgressDestination parses CIDR or a single address, which is taken as /32 or /128
+func parseEgressDestination(destination string) (*net.IPNet, error) {
+	if _, subnet, err := net.ParseCIDR(destination); err == nil {
+		return subnet, nil
+	}
+	ip := net.ParseIP(destination)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid destination %s", destination)
+	}
+	if ip.To4() != nil {
+		return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// ParseEgressRule parses allow-list entry cidr[:port[/tcp|udp]], IPv6 CIDR is put in brackets when
+// a port is given like [2001:db8::/32]:443/tcp
+func ParseEgressRule(spec string) (*EgressRule, error) {
+	destination, portSpec := spec, ""
+	if strings.HasPrefix(spec, "[") {
+		end := strings.Index(spec, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("invalid egress rule %s", spec)
+		}
+		destination = spec[1:end]
+		if rest := spec[end+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return nil, fmt.Errorf("invalid egress rule %s", spec)
+			}
+			portSpec = rest[1:]
+		}
+	} else if index := strings.LastIndex(spec, ":"); index >= 0 && strings.Count(spec, ":") == 1 {
+		destination, portSpec = spec[:index], spec[index+1:]
+	}
+
+	subnet, err := parseEgressDestination(destination)
+	if err != nil {
+		return nil, fmt.Errorf("invalid egress rule %s: %w", spec, err)
+	}
+	rule := &EgressRule{Subnet: subnet}
+	if portSpec == "" {
+		return rule, nil
+	}
+
+	port, protocol, _ := strings.Cut(portSpec, "/")
+	if rule.Port, err = strconv.Atoi(port); err != nil || rule.Port < 1 || rule.Port > 65535 {
+		return nil, fmt.Errorf("invalid port %s in egress rule %s", port, spec)
+	}
+	if protocol != "" && protocol != "tcp" && protocol != "udp" {
+		return nil, fmt.Errorf("invalid protocol %s in egress rule %s, only tcp and udp are supported", protocol, spec)
+	}
+	rule.Protocol = protocol
+
+	return rule, nil
+}
+
+// getFamily returns nftables family keyword of an address
+func getFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ip"
+	}
+	return "ip6"
+}
+
+// getMatch returns nftables expression matching traffic allowed by the rule
+func (r *EgressRule) getMatch() string {
+	match := fmt.Sprintf("%s daddr %s", getFamily(r.Subnet.IP), r.Subnet.String())
+	switch {
+	case r.Port == 0:
+		return match
+	case r.Protocol == "":
+		return fmt.Sprintf("%s meta l4proto { tcp, udp } th dport %d", match, r.Port)
+	}
+
+	return fmt.Sprintf("%s %s dport %d", match, r.Protocol, r.Port)
+}
+
+// EgressEndpoint is an endpoint of a container whose egress traffic is filtered, DNSServer is address
+// of the embedded DNS server of its network, empty if it has none
+type EgressEndpoint struct {
+	HostVeth  string
+	Addresses []string
+	DNSServer string
+}
+
+// getEndpointEgressRules returns rules filtering frames from host side veth of an endpoint, source
+// address must be one of the endpoint as well so traffic of addresses added in container never passes
+func getEndpointEgressRules(endpoint *EgressEndpoint, rules []*EgressRule) []string {
+	iif := fmt.Sprintf("iifname \"%s\"", endpoint.HostVeth)
+	allowed := []string{iif + " ct state established,related accept"}
+	for _, address := range endpoint.Addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			continue
+		}
+		source := fmt.Sprintf("%s %s saddr %s", iif, getFamily(ip), ip.String())
+		//Address resolution with gateway and other containers, IPv6 one is sent from link-local address too
+		if getFamily(ip) == "ip" {
+			allowed = append(allowed, fmt.Sprintf("%s arp saddr ip %s accept", iif, ip.String()))
+		} else {
+			allowed = append(allowed, fmt.Sprintf("%s ip6 saddr { %s, fe80::/10 } icmpv6 type { nd-neighbor-solicit, nd-neighbor-advert, nd-router-solicit } accept", iif, ip.String()))
+		}
+		for _, rule := range rules {
+			if getFamily(rule.Subnet.IP) == getFamily(ip) {
+				allowed = append(allowed, source+" "+rule.getMatch()+" accept")
+			}
+		}
+		if serverIP := net.ParseIP(endpoint.DNSServer); serverIP != nil && getFamily(serverIP) == getFamily(ip) {
+			allowed = append(allowed, fmt.Sprintf("%s %s daddr %s meta l4proto { tcp, udp } th dport 53 accept", source, getFamily(ip), endpoint.DNSServer))
+		}
+	}
+
+	return append(allowed, iif+" drop")
+}
+
+// SetupEgressRules replaces egress rules of a container: frames from host side veths of its endpoints
+// to other containers (chain egress) and to host or outside (chain egress-local) are dropped unless
+// allowed by one of rules. Replies of allowed connections and queries to embedded DNS servers pass
+func SetupEgressRules(containerId string, endpoints []*EgressEndpoint, rules []*EgressRule) error {
+	comment := getEgressRuleComment(containerId)
+	if err := deleteFirewallRules(comment); err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	var endpointRules []string
+	for _, endpoint := range endpoints {
+		if endpoint.HostVeth != "" {
+			endpointRules = append(endpointRules, getEndpointEgressRules(endpoint, rules)...)
+		}
+	}
+	if len(endpointRules) == 0 {
+		return nil
+	}
+	//Rules are in bridge family, where ct state only works with nf_conntrack_bridge. Without it replies
+	//of allowed connections would never match established and be dropped
+	if err := enableBridgeConntrack(); err != nil {
+		return err
+	}
+
+	for _, chain := range []string{"egress", "egress-local"} {
+		if err := addBridgeFirewallRules(chain, comment, endpointRules...); err != nil {
+			deleteFirewallRules(comment)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Present once nf_conntrack_bridge is loaded
+const bridgeConntrackModulePath = "/sys/module/nf_conntrack_bridge"
+
+// enableBridgeConntrack loads nf_conntrack_bridge, which tracks connections of frames seen by bridge
+// family chains. br_netfilter doesn't, it only passes bridged traffic to inet family hooks
+func enableBridgeConntrack() error {
+	if _, err := os.Stat(bridgeConntrackModulePath); err == nil {
+		return nil
+	}
+	if output, err := exec.Command("modprobe", "nf_conntrack_bridge").CombinedOutput(); err != nil {
+		return fmt.Errorf("egress allow-list needs nf_conntrack_bridge, failed to load it: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// DeleteEgressRules removes egress rules of a container
+func DeleteEgressRules(containerId string) error {
+	return deleteFirewallRules(getEgressRuleComment(containerId))
+}
@@ -0,0 +1,194 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// All go-docker rules live in nftables tables of this name, so they never mix with rules of other tools
+const firewallTable = "go-docker"
+
+// Full ruleset of the table: base chains and sets, published ports go to chain publish which is jumped
+// to for local destinations, set bridges holds bridges of all networks. Chains prerouting and output
+// hold only the jumps, which are flushed and added again, so the script is idempotent and run as one
+// transaction even if two runs create the table at once
+const firewallSetup = `
+add table inet go-docker
+add set inet go-docker bridges { type ifname; }
+add chain inet go-docker publish
+add chain inet go-docker prerouting { type nat hook prerouting priority dstnat; policy accept; }
+add chain inet go-docker output { type nat hook output priority -100; policy accept; }
+add chain inet go-docker postrouting { type nat hook postrouting priority srcnat; policy accept; }
+add chain inet go-docker forward { type filter hook forward priority filter; policy accept; }
+flush chain inet go-docker prerouting
+flush chain inet go-docker output
+add rule inet go-docker prerouting fib daddr type local jump publish
+add rule inet go-docker output ip daddr != 127.0.0.0/8 fib daddr type local jump publish
+add rule inet go-docker output ip6 daddr != ::1 fib daddr type local jump publish
+`
+
+// Chains of bridge family table, where input interface is the bridge port a frame comes from instead of
+// the bridge, so rules can match the host side veth of a container. Chain egress sees frames to other
+// ports of the bridge and egress-local frames to the bridge itself, which are for host or routed out
+const bridgeFirewallSetup = `
+add table bridge go-docker
+add chain bridge go-docker egress { type filter hook forward priority filter; policy accept; }
+add chain bridge go-docker egress-local { type filter hook input priority filter; policy accept; }
+`
+
+var nftHandlePattern = regexp.MustCompile(`# handle (\d+)$`)
+var nftCommentPattern = regexp.MustCompile(`comment "([^"]*)"`)
+
+func runNft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+func listTable(family string) (string, error) {
+	output, err := exec.Command("nft", "-a", "list", "table", family, firewallTable).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to list nft table: %w", err)
+	}
+
+	return string(output), nil
+}
+
+// listFirewallTable lists rules of inet and bridge go-docker tables, missing tables are left out
+func listFirewallTable() (string, error) {
+	inet, inetErr := listTable("inet")
+	bridge, bridgeErr := listTable("bridge")
+	if inetErr != nil && bridgeErr != nil {
+		return "", inetErr
+	}
+
+	return inet + bridge, nil
+}
+
+// ensureFirewallTable creates go-docker table with its full ruleset if it doesn't exist yet
+func ensureFirewallTable() error {
+	if _, err := listTable("inet"); err == nil {
+		return nil
+	}
+
+	return runNft(firewallSetup)
+}
+
+func getAddRulesScript(family string, chain string, comment string, rules []string) string {
+	var script strings.Builder
+	for _, rule := range rules {
+		fmt.Fprintf(&script, "add rule %s %s %s %s comment \"%s\"\n", family, firewallTable, chain, rule, comment)
+	}
+
+	return script.String()
+}
+
+// addFirewallRules appends rules to a chain of go-docker table, tagged with comment for deletion later
+func addFirewallRules(chain string, comment string, rules ...string) error {
+	if err := ensureFirewallTable(); err != nil {
+		return err
+	}
+
+	return runNft(getAddRulesScript("inet", chain, comment, rules))
+}
+
+// addBridgeFirewallRules appends rules to a chain of bridge family go-docker table
+func addBridgeFirewallRules(chain string, comment string, rules ...string) error {
+	if err := runNft(bridgeFirewallSetup); err != nil {
+		return err
+	}
+
+	return runNft(getAddRulesScript("bridge", chain, comment, rules))
+}
+
+// hasFirewallRules checks if any rule is tagged with comment
+func hasFirewallRules(comment string) bool {
+	table, err := listFirewallTable()
+	if err != nil {
+		return false
+	}
+
+	return strings.Contains(table, "comment \""+comment+"\"")
+}
+
+// getFirewallRuleComments returns distinct comments of rules which start with prefix
+func getFirewallRuleComments(prefix string) []string {
+	table, err := listFirewallTable()
+	if err != nil {
+		return nil
+	}
+
+	var comments []string
+	seen := map[string]bool{}
+	for _, match := range nftCommentPattern.FindAllStringSubmatch(table, -1) {
+		if strings.HasPrefix(match[1], prefix) && !seen[match[1]] {
+			seen[match[1]] = true
+			comments = append(comments, match[1])
+		}
+	}
+
+	return comments
+}
+
+// deleteFirewallRules deletes all rules tagged with comment from go-docker tables
+func deleteFirewallRules(comment string) error {
+	table, err := listFirewallTable()
+	if err != nil {
+		//Nothing to delete if the table was never created
+		return nil
+	}
+
+	var script bytes.Buffer
+	family, chain := "", ""
+	scanner := bufio.NewScanner(strings.NewReader(table))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "table ") {
+			family = strings.Fields(line)[1]
+			continue
+		}
+		if strings.HasPrefix(line, "chain ") {
+			chain = strings.Fields(line)[1]
+			continue
+		}
+		if !strings.Contains(line, "comment \""+comment+"\"") {
+			continue
+		}
+		if match := nftHandlePattern.FindStringSubmatch(line); match != nil {
+			fmt.Fprintf(&script, "delete rule %s %s %s handle %s\n", family, firewallTable, chain, match[1])
+		}
+	}
+
+	if script.Len() == 0 {
+		return nil
+	}
+
+	return runNft(script.String())
+}
+
+// addFirewallSetElement adds an element to a set of go-docker table, adding an existing element is no-op
+func addFirewallSetElement(set string, element string) error {
+	if err := ensureFirewallTable(); err != nil {
+		return err
+	}
+
+	return runNft(fmt.Sprintf("add element inet %s %s { %s }\n", firewallTable, set, element))
+}
+
+// deleteFirewallSetElement deletes an element from a set of go-docker table if it is there
+func deleteFirewallSetElement(set string, element string) error {
+	output, err := exec.Command("nft", "list", "set", "inet", firewallTable, set).Output()
+	if err != nil || !strings.Contains(string(output), element) {
+		return nil
+	}
+
+	return runNft(fmt.Sprintf("delete element inet %s %s { %s }\n", firewallTable, set, element))
+}
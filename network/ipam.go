@@ -0,0 +1,206 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-docker/utils"
+	"net/netip"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Pool keeps leases of the subnet of one network, stored as json under network directory
+type Pool struct {
+	Subnet    string
+	Gateway   string
+	SubnetV6  string
+	GatewayV6 string
+	//Leased IP address to ID of the container holding it, for both families
+	Leases map[string]string
+	//Last allocated address, allocation continues after it so released addresses are not reused at once
+	Last   string
+	LastV6 string
+}
+
+// getIPAMPath returns directory of pools and their lock, a variable so tests can keep pools in a temp directory
+var getIPAMPath = func() string {
+	return utils.GetDockerNetworkPath() + "/ipam"
+}
+
+func getPoolPath(name string) string {
+	return getIPAMPath() + "/" + name + ".json"
+}
+
+// getHostRange returns first and last usable addresses of subnet, the subnet address itself is excluded
+// and so is broadcast address of IPv4 subnet. Subnet too small to have any is an error
+func getHostRange(subnet netip.Prefix) (netip.Addr, netip.Addr, error) {
+	first := subnet.Masked().Addr()
+	last := first.AsSlice()
+	hostBits := first.BitLen() - subnet.Bits()
+	for i := len(last) - 1; i >= 0 && hostBits > 0; i-- {
+		bits := min(hostBits, 8)
+		last[i] |= byte(1<<bits - 1)
+		hostBits -= bits
+	}
+	lastAddr, _ := netip.AddrFromSlice(last)
+	if first.Is4() {
+		lastAddr = lastAddr.Prev()
+	}
+	first = first.Next()
+	if !first.IsValid() || !lastAddr.IsValid() || first.Compare(lastAddr) > 0 {
+		return netip.Addr{}, netip.Addr{}, fmt.Errorf("subnet %s has no usable address", subnet.String())
+	}
+
+	return first, lastAddr, nil
+}
+
+// isHostAddress checks if address is a usable address of subnet
+func isHostAddress(subnet netip.Prefix, addr netip.Addr) bool {
+	first, last, err := getHostRange(subnet)
+	return err == nil && addr.Compare(first) >= 0 && addr.Compare(last) <= 0
+}
+
+// withPool loads, modifies and saves a pool while holding the IPAM lock
+func withPool(name string, modify func(pool *Pool) error) error {
+	if err := os.MkdirAll(getIPAMPath(), utils.File_OtherReadExecute); err != nil {
+		return err
+	}
+	lockFile, err := os.OpenFile(getIPAMPath()+"/ipam.lock", os.O_CREATE|os.O_RDWR, utils.File_OtherReadOnly)
+	if err != nil {
+		return err
+	}
+	defer lockFile.Close()
+
+	if err := unix.Flock(int(lockFile.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+	defer unix.Flock(int(lockFile.Fd()), unix.LOCK_UN)
+
+	pool := &Pool{}
+	if data, err := os.ReadFile(getPoolPath(name)); err == nil {
+		if err := json.Unmarshal(data, pool); err != nil {
+			return fmt.Errorf("failed to parse IPAM pool %s: %w", name, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if pool.Leases == nil {
+		pool.Leases = map[string]string{}
+	}
+
+	if err := modify(pool); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(pool, "", "  ")
+	if err != nil {
+		return err
+	}
+	//Write to a temp file then rename, so a crash never leaves a half written pool
+	tempPath := getPoolPath(name) + ".tmp"
+	if err := os.WriteFile(tempPath, data, utils.File_OtherReadOnly); err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, getPoolPath(name))
+}
+
+// AllocateIP leases an address of subnet to a container, requested address is leased if it is free,
+// otherwise the next free address after the last allocated one is picked
+func AllocateIP(name string, subnet netip.Prefix, gateway netip.Addr, requested string, containerId string) (string, error) {
+	var allocated string
+	err := withPool(name, func(pool *Pool) error {
+		last := &pool.Last
+		if subnet.Addr().Is4() {
+			pool.Subnet = subnet.String()
+			pool.Gateway = gateway.String()
+		} else {
+			pool.SubnetV6 = subnet.String()
+			pool.GatewayV6 = gateway.String()
+			last = &pool.LastV6
+		}
+
+		if requested != "" {
+			addr, err := netip.ParseAddr(requested)
+			if err != nil || addr.Is4() != subnet.Addr().Is4() || !subnet.Contains(addr) {
+				return fmt.Errorf("address %s is not in subnet %s", requested, subnet.String())
+			}
+			if !isHostAddress(subnet, addr) || addr == gateway {
+				return fmt.Errorf("address %s is reserved", requested)
+			}
+			if owner, found := pool.Leases[addr.String()]; found && owner != containerId {
+				return fmt.Errorf("address %s is already in use by container %s", requested, owner)
+			}
+			allocated = addr.String()
+			pool.Leases[allocated] = containerId
+			return nil
+		}
+
+		first, lastHost, err := getHostRange(subnet)
+		if err != nil {
+			return err
+		}
+		start := first
+		if lastAddr, err := netip.ParseAddr(*last); err == nil && isHostAddress(subnet, lastAddr) && lastAddr != lastHost {
+			start = lastAddr.Next()
+		}
+		//Walk from start and wrap around at the end of subnet, until an address is free or all are checked
+		for addr := start; ; {
+			_, leased := pool.Leases[addr.String()]
+			if addr != gateway && !leased {
+				allocated = addr.String()
+				pool.Leases[allocated] = containerId
+				*last = allocated
+				return nil
+			}
+
+			if addr == lastHost {
+				addr = first
+			} else {
+				addr = addr.Next()
+			}
+			if addr == start {
+				break
+			}
+		}
+
+		return fmt.Errorf("no free address left in subnet %s", subnet.String())
+	})
+
+	return allocated, err
+}
+
+// ReleaseIP releases the lease of a container, it does nothing if the address is leased by someone else
+func ReleaseIP(name string, ip string, containerId string) error {
+	return withPool(name, func(pool *Pool) error {
+		if owner, found := pool.Leases[ip]; found && owner == containerId {
+			delete(pool.Leases, ip)
+		}
+		return nil
+	})
+}
+
+// AllocateNetworkIP leases an IPv4 address of the network subnet
+func AllocateNetworkIP(nw *Network, requested string, containerId string) (string, error) {
+	subnet, gateway, err := nw.getPrefix(nw.Subnet, nw.Gateway)
+	if err != nil {
+		return "", err
+	}
+
+	return AllocateIP(nw.Name, subnet, gateway, requested, containerId)
+}
+
+// AllocateNetworkIPv6 leases an IPv6 address of the network subnet, network must have IPv6 enabled
+func AllocateNetworkIPv6(nw *Network, requested string, containerId string) (string, error) {
+	subnet, gateway, err := nw.getPrefix(nw.SubnetV6, nw.GatewayV6)
+	if err != nil {
+		return "", err
+	}
+
+	return AllocateIP(nw.Name, subnet, gateway, requested, containerId)
+}
+
+func removePool(name string) error {
+	return os.Remove(getPoolPath(name))
+}
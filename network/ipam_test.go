@@ -0,0 +1,198 @@
+package network
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// useTempIPAMPath keeps pools of the test in a temp directory
+func useTempIPAMPath(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	saved := getIPAMPath
+	getIPAMPath = func() string { return dir }
+	t.Cleanup(func() { getIPAMPath = saved })
+}
+
+func TestGetHostRange(t *testing.T) {
+	tests := []struct {
+		subnet  string
+		first   string
+		last    string
+		wantErr bool
+	}{
+		{subnet: "10.0.0.0/24", first: "10.0.0.1", last: "10.0.0.254"},
+		{subnet: "10.0.0.77/24", first: "10.0.0.1", last: "10.0.0.254"},
+		{subnet: "172.30.0.0/16", first: "172.30.0.1", last: "172.30.255.254"},
+		{subnet: "10.1.2.0/23", first: "10.1.2.1", last: "10.1.3.254"},
+		{subnet: "10.0.0.0/30", first: "10.0.0.1", last: "10.0.0.2"},
+		{subnet: "10.0.0.0/31", wantErr: true},
+		{subnet: "10.0.0.0/32", wantErr: true},
+		{subnet: "fd00:1::/64", first: "fd00:1::1", last: "fd00:1::ffff:ffff:ffff:ffff"},
+		{subnet: "fd00:1::/120", first: "fd00:1::1", last: "fd00:1::ff"},
+		{subnet: "fd00:1::/126", first: "fd00:1::1", last: "fd00:1::3"},
+		{subnet: "fd00:1::/128", wantErr: true},
+	}
+
+	for _, test := range tests {
+		first, last, err := getHostRange(netip.MustParsePrefix(test.subnet))
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("getHostRange(%s) = %s-%s, want error", test.subnet, first, last)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("getHostRange(%s) failed: %v", test.subnet, err)
+			continue
+		}
+		if first.String() != test.first || last.String() != test.last {
+			t.Errorf("getHostRange(%s) = %s-%s, want %s-%s", test.subnet, first, last, test.first, test.last)
+		}
+	}
+}
+
+func TestParseSubnetPrefixBoundary(t *testing.T) {
+	tests := []struct {
+		subnet  string
+		isIPv6  bool
+		gateway string
+		wantErr bool
+	}{
+		{subnet: "10.0.0.0/30", gateway: "10.0.0.1"},
+		{subnet: "10.0.0.0/31", wantErr: true},
+		{subnet: "10.0.0.0/32", wantErr: true},
+		{subnet: "fd00:1::/126", isIPv6: true, gateway: "fd00:1::1"},
+		{subnet: "fd00:1::/127", isIPv6: true, wantErr: true},
+		{subnet: "fd00:1::/128", isIPv6: true, wantErr: true},
+		{subnet: "fd00:1::/64", wantErr: true},
+		{subnet: "10.0.0.0/24", isIPv6: true, wantErr: true},
+	}
+
+	for _, test := range tests {
+		_, gateway, err := parseSubnet(test.subnet, "", test.isIPv6, nil, false)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseSubnet(%s) succeeded, want error", test.subnet)
+			}
+			continue
+		}
+		if err != nil || gateway.String() != test.gateway {
+			t.Errorf("parseSubnet(%s) = %v, %v, want gateway %s", test.subnet, gateway, err, test.gateway)
+		}
+	}
+}
+
+func TestAllocateIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		subnet  string
+		gateway string
+		//Leases existing before the allocation, address to container
+		leases    map[string]string
+		last      string
+		requested string
+		want      string
+		wantErr   bool
+	}{
+		{name: "first address after gateway", subnet: "10.0.0.0/24", gateway: "10.0.0.1", want: "10.0.0.2"},
+		{name: "continues after last", subnet: "10.0.0.0/24", gateway: "10.0.0.1", last: "10.0.0.9", want: "10.0.0.10"},
+		{name: "skips leased", subnet: "10.0.0.0/24", gateway: "10.0.0.1", last: "10.0.0.9",
+			leases: map[string]string{"10.0.0.10": "other"}, want: "10.0.0.11"},
+		{name: "wraps around at end", subnet: "10.0.0.0/24", gateway: "10.0.0.1", last: "10.0.0.254", want: "10.0.0.2"},
+		{name: "wraps around past leases", subnet: "10.0.0.0/24", gateway: "10.0.0.1", last: "10.0.0.253",
+			leases: map[string]string{"10.0.0.254": "other", "10.0.0.2": "other"}, want: "10.0.0.3"},
+		{name: "gateway not first", subnet: "10.0.0.0/24", gateway: "10.0.0.254", last: "10.0.0.253", want: "10.0.0.1"},
+		{name: "smallest subnet", subnet: "10.0.0.0/30", gateway: "10.0.0.1", want: "10.0.0.2"},
+		{name: "smallest subnet full", subnet: "10.0.0.0/30", gateway: "10.0.0.1",
+			leases: map[string]string{"10.0.0.2": "other"}, wantErr: true},
+		{name: "smallest IPv6 subnet", subnet: "fd00::/126", gateway: "fd00::1",
+			leases: map[string]string{"fd00::2": "other"}, want: "fd00::3"},
+		{name: "smallest IPv6 subnet full", subnet: "fd00::/126", gateway: "fd00::1",
+			leases: map[string]string{"fd00::2": "other", "fd00::3": "other"}, wantErr: true},
+		{name: "IPv6 wraps around", subnet: "fd00::/120", gateway: "fd00::1", last: "fd00::ff", want: "fd00::2"},
+		{name: "requested", subnet: "10.0.0.0/24", gateway: "10.0.0.1", requested: "10.0.0.50", want: "10.0.0.50"},
+		{name: "requested leased to itself", subnet: "10.0.0.0/24", gateway: "10.0.0.1",
+			leases: map[string]string{"10.0.0.50": "test"}, requested: "10.0.0.50", want: "10.0.0.50"},
+		{name: "requested in use", subnet: "10.0.0.0/24", gateway: "10.0.0.1",
+			leases: map[string]string{"10.0.0.50": "other"}, requested: "10.0.0.50", wantErr: true},
+		{name: "requested gateway", subnet: "10.0.0.0/24", gateway: "10.0.0.1", requested: "10.0.0.1", wantErr: true},
+		{name: "requested broadcast", subnet: "10.0.0.0/24", gateway: "10.0.0.1", requested: "10.0.0.255", wantErr: true},
+		{name: "requested subnet address", subnet: "10.0.0.0/24", gateway: "10.0.0.1", requested: "10.0.0.0", wantErr: true},
+		{name: "requested outside subnet", subnet: "10.0.0.0/24", gateway: "10.0.0.1", requested: "10.0.1.5", wantErr: true},
+		{name: "requested other family", subnet: "10.0.0.0/24", gateway: "10.0.0.1", requested: "fd00::5", wantErr: true},
+		{name: "requested IPv6 last address", subnet: "fd00::/126", gateway: "fd00::1", requested: "fd00::3", want: "fd00::3"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTempIPAMPath(t)
+			subnet := netip.MustParsePrefix(test.subnet)
+			if err := withPool("test", func(pool *Pool) error {
+				for address, owner := range test.leases {
+					pool.Leases[address] = owner
+				}
+				if subnet.Addr().Is4() {
+					pool.Last = test.last
+				} else {
+					pool.LastV6 = test.last
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := AllocateIP("test", subnet, netip.MustParseAddr(test.gateway), test.requested, "test")
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("AllocateIP = %s, want error", got)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Fatalf("AllocateIP = %s, %v, want %s", got, err, test.want)
+			}
+			withPool("test", func(pool *Pool) error {
+				if pool.Leases[got] != "test" {
+					t.Errorf("Address %s leased to %q, want test", got, pool.Leases[got])
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestReleaseIP(t *testing.T) {
+	useTempIPAMPath(t)
+	subnet := netip.MustParsePrefix("10.0.0.0/30")
+	gateway := netip.MustParseAddr("10.0.0.1")
+
+	address, err := AllocateIP("test", subnet, gateway, "", "first")
+	if err != nil {
+		t.Fatalf("AllocateIP failed: %v", err)
+	}
+	if _, err := AllocateIP("test", subnet, gateway, "", "second"); err == nil {
+		t.Fatalf("AllocateIP succeeded in a full subnet")
+	}
+
+	//Lease of another container is kept
+	if err := ReleaseIP("test", address, "second"); err != nil {
+		t.Fatalf("ReleaseIP failed: %v", err)
+	}
+	if _, err := AllocateIP("test", subnet, gateway, "", "second"); err == nil {
+		t.Fatalf("Address released by a container which didn't hold it")
+	}
+
+	if err := ReleaseIP("test", address, "first"); err != nil {
+		t.Fatalf("ReleaseIP failed: %v", err)
+	}
+	got, err := AllocateIP("test", subnet, gateway, "", "second")
+	if err != nil || got != address {
+		t.Errorf("AllocateIP after release = %s, %v, want %s", got, err, address)
+	}
+
+	//Releasing an address which isn't leased is fine
+	if err := ReleaseIP("test", "10.0.0.3", "first"); err != nil {
+		t.Errorf("ReleaseIP of free address failed: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package network
+
+import (
+	"fmt"
+	"go-docker/state"
+	"go-docker/utils"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// getParentLink returns the host interface containers of a macvlan or ipvlan network sit on
+func getParentLink(nw *Network) (netlink.Link, error) {
+	parent, err := netlink.LinkByName(nw.Parent)
+	if err != nil {
+		return nil, fmt.Errorf("parent interface %s of network %s not found: %w", nw.Parent, nw.Name, err)
+	}
+
+	return parent, nil
+}
+
+// deleteSubLink deletes link of a macvlan or ipvlan endpoint. The link has no host side, so it is
+// looked up on host first, where it stays until the container starts, then in network namespace of container
+func deleteSubLink(containerId string, endpoint *state.Endpoint) error {
+	if link, err := netlink.LinkByName(endpoint.ContainerVeth); err == nil {
+		return netlink.LinkDel(link)
+	}
+
+	fd, err := unix.Open(utils.GetDockerNetNsPath()+"/"+containerId, unix.O_RDONLY, 0)
+	if err != nil {
+		//Network namespace is gone with the link
+		return nil
+	}
+	defer unix.Close(fd)
+	handle, err := netlink.NewHandleAt(netns.NsHandle(fd))
+	if err != nil {
+		return err
+	}
+	defer handle.Delete()
+
+	link, err := handle.LinkByName(endpoint.ContainerVeth)
+	if err != nil {
+		return nil
+	}
+	return handle.LinkDel(link)
+}
+
+// macvlanDriver gives each container its own MAC address on the parent interface, so containers appear
+// as hosts on its L2 segment. Gateway is a router of that segment, and like Docker host can't reach
+// containers through the parent interface
+type macvlanDriver struct{}
+
+func (d *macvlanDriver) Setup(nw *Network) error {
+	_, err := getParentLink(nw)
+	return err
+}
+
+func (d *macvlanDriver) Teardown(nw *Network) error {
+	return nil
+}
+
+func (d *macvlanDriver) CreateEndpoint(nw *Network, endpoint *state.Endpoint) error {
+	parent, err := getParentLink(nw)
+	if err != nil {
+		return err
+	}
+	mac, err := net.ParseMAC(endpoint.MacAddress)
+	if err != nil {
+		return err
+	}
+
+	linkAttrs := netlink.NewLinkAttrs()
+	linkAttrs.Name = endpoint.ContainerVeth
+	linkAttrs.ParentIndex = parent.Attrs().Index
+	linkAttrs.HardwareAddr = mac
+	endpoint.HostVeth = ""
+
+	return netlink.LinkAdd(&netlink.Macvlan{LinkAttrs: linkAttrs, Mode: netlink.MACVLAN_MODE_BRIDGE})
+}
+
+func (d *macvlanDriver) DeleteEndpoint(containerId string, endpoint *state.Endpoint) error {
+	return deleteSubLink(containerId, endpoint)
+}
+
+func (d *macvlanDriver) HostIsGateway() bool {
+	return false
+}
+
+// ipvlanDriver works like macvlan in L2 mode, but containers share MAC address of the parent interface,
+// for segments which allow one MAC address per switch port
+type ipvlanDriver struct{}
+
+func (d *ipvlanDriver) Setup(nw *Network) error {
+	_, err := getParentLink(nw)
+	return err
+}
+
+func (d *ipvlanDriver) Teardown(nw *Network) error {
+	return nil
+}
+
+func (d *ipvlanDriver) CreateEndpoint(nw *Network, endpoint *state.Endpoint) error {
+	parent, err := getParentLink(nw)
+	if err != nil {
+		return err
+	}
+
+	linkAttrs := netlink.NewLinkAttrs()
+	linkAttrs.Name = endpoint.ContainerVeth
+	linkAttrs.ParentIndex = parent.Attrs().Index
+	endpoint.HostVeth = ""
+	endpoint.MacAddress = parent.Attrs().HardwareAddr.String()
+
+	return netlink.LinkAdd(&netlink.IPVlan{LinkAttrs: linkAttrs, Mode: netlink.IPVLAN_MODE_L2})
+}
+
+func (d *ipvlanDriver) DeleteEndpoint(containerId string, endpoint *state.Endpoint) error {
+	return deleteSubLink(containerId, endpoint)
+}
+
+func (d *ipvlanDriver) HostIsGateway() bool {
+	return false
+}
@@ -0,0 +1,134 @@
+package network
+
+import (
+	"go-docker/state"
+	"os"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+const testParentName = "gdtest0"
+
+// createDummyParent creates a dummy link to be the parent of macvlan and ipvlan links, the test is
+// skipped without root or where links can't be created
+func createDummyParent(t *testing.T) netlink.Link {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("Creating links needs root")
+	}
+	linkAttrs := netlink.NewLinkAttrs()
+	linkAttrs.Name = testParentName
+	if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: linkAttrs}); err != nil {
+		t.Skipf("Failed to create dummy link: %v", err)
+	}
+	t.Cleanup(func() {
+		if link, err := netlink.LinkByName(testParentName); err == nil {
+			netlink.LinkDel(link)
+		}
+	})
+
+	parent, err := netlink.LinkByName(testParentName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parent
+}
+
+func TestSubLinkEndpoints(t *testing.T) {
+	parent := createDummyParent(t)
+
+	tests := []struct {
+		driver   string
+		linkType string
+	}{
+		{DriverMacvlan, "macvlan"},
+		{DriverIPvlan, "ipvlan"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.driver, func(t *testing.T) {
+			nw := &Network{Name: "test", Driver: test.driver, Parent: testParentName, Subnet: "10.99.0.0/24", Gateway: "10.99.0.1"}
+			driver, err := GetDriver(test.driver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if driver.HostIsGateway() {
+				t.Errorf("Host is gateway of %s network", test.driver)
+			}
+			if err := driver.Setup(nw); err != nil {
+				t.Fatalf("Setup failed: %v", err)
+			}
+
+			endpoint := &state.Endpoint{
+				ContainerVeth: "gdtestc0",
+				HostVeth:      "unused",
+				MacAddress:    "02:42:0a:63:00:02",
+			}
+			if err := driver.CreateEndpoint(nw, endpoint); err != nil {
+				t.Fatalf("CreateEndpoint failed: %v", err)
+			}
+			t.Cleanup(func() {
+				if link, err := netlink.LinkByName(endpoint.ContainerVeth); err == nil {
+					netlink.LinkDel(link)
+				}
+			})
+
+			link, err := netlink.LinkByName(endpoint.ContainerVeth)
+			if err != nil {
+				t.Fatalf("Link of endpoint not created: %v", err)
+			}
+			if link.Type() != test.linkType {
+				t.Errorf("Link type %s, want %s", link.Type(), test.linkType)
+			}
+			if link.Attrs().ParentIndex != parent.Attrs().Index {
+				t.Errorf("Link parent index %d, want %d", link.Attrs().ParentIndex, parent.Attrs().Index)
+			}
+			if endpoint.HostVeth != "" {
+				t.Errorf("Endpoint has host side %s, want none", endpoint.HostVeth)
+			}
+			//Macvlan link has its own MAC address, ipvlan shares the one of parent
+			wantMac := endpoint.MacAddress
+			if test.driver == DriverIPvlan {
+				wantMac = parent.Attrs().HardwareAddr.String()
+				if endpoint.MacAddress != wantMac {
+					t.Errorf("Endpoint MAC address %s, want parent's %s", endpoint.MacAddress, wantMac)
+				}
+			}
+			if link.Attrs().HardwareAddr.String() != wantMac {
+				t.Errorf("Link MAC address %s, want %s", link.Attrs().HardwareAddr, wantMac)
+			}
+
+			if err := driver.DeleteEndpoint("0123456789ab", endpoint); err != nil {
+				t.Fatalf("DeleteEndpoint failed: %v", err)
+			}
+			if _, err := netlink.LinkByName(endpoint.ContainerVeth); err == nil {
+				t.Errorf("Link still exists after DeleteEndpoint")
+			}
+			//Link gone with network namespace of container is fine
+			if err := driver.DeleteEndpoint("0123456789ab", endpoint); err != nil {
+				t.Errorf("DeleteEndpoint of deleted link failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestSubLinkMissingParent(t *testing.T) {
+	for _, driverName := range []string{DriverMacvlan, DriverIPvlan} {
+		nw := &Network{Name: "test", Driver: driverName, Parent: "gdmissing0"}
+		driver, err := GetDriver(driverName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := driver.Setup(nw); err == nil {
+			t.Errorf("Setup of %s network succeeded without parent", driverName)
+		}
+		endpoint := &state.Endpoint{ContainerVeth: "gdtestc1", MacAddress: "02:42:0a:63:00:03"}
+		if err := driver.CreateEndpoint(nw, endpoint); err == nil {
+			t.Errorf("CreateEndpoint of %s network succeeded without parent", driverName)
+			if link, err := netlink.LinkByName(endpoint.ContainerVeth); err == nil {
+				netlink.LinkDel(link)
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package network
+
+import (
+	"go-docker/utils"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+const ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+const ipv6ForwardPath = "/proc/sys/net/ipv6/conf/all/forwarding"
+
+// Prefix of comments tagging masquerade rules of bridges
+const natRuleCommentPrefix = "go-docker:network:"
+
+func getNATRuleComment(bridge string) string {
+	return natRuleCommentPrefix + bridge
+}
+
+// File remembering forwarding was turned on by go-docker, so it is restored when not needed anymore
+func getIPForwardMarkPath(forwardPath string) string {
+	if forwardPath == ipv6ForwardPath {
+		return utils.GetDockerNetworkPath() + "/ipv6_forward.enabled"
+	}
+	return utils.GetDockerNetworkPath() + "/ip_forward.enabled"
+}
+
+// enableIPForward turns on forwarding if it is off, and remembers it was changed by us
+func enableIPForward(forwardPath string) error {
+	data, err := os.ReadFile(forwardPath)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(data)) == "1" {
+		return nil
+	}
+
+	if err := os.WriteFile(forwardPath, []byte("1"), 0644); err != nil {
+		return err
+	}
+
+	return os.WriteFile(getIPForwardMarkPath(forwardPath), []byte("0"), utils.File_OtherReadOnly)
+}
+
+// restoreIPForward turns forwarding off again, only if it was turned on by go-docker
+func restoreIPForward(forwardPath string) error {
+	if _, err := os.Stat(getIPForwardMarkPath(forwardPath)); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.WriteFile(forwardPath, []byte("0"), 0644); err != nil {
+		return err
+	}
+
+	return os.Remove(getIPForwardMarkPath(forwardPath))
+}
+
+// SetupBridgeNAT lets containers on the bridge reach outside: it enables forwarding and masquerades
+// traffic from the bridge subnets leaving through other interfaces, subnetV6 is nil if IPv6 is not
+// enabled. Calling it again changes nothing
+func SetupBridgeNAT(bridge string, subnet *net.IPNet, subnetV6 *net.IPNet) error {
+	if err := enableIPForward(ipForwardPath); err != nil {
+		return err
+	}
+	if subnetV6 != nil {
+		if err := enableIPForward(ipv6ForwardPath); err != nil {
+			return err
+		}
+	}
+
+	comment := getNATRuleComment(bridge)
+	if hasFirewallRules(comment) {
+		return nil
+	}
+
+	rules := []string{"ip saddr " + subnet.String() + " oifname != \"" + bridge + "\" masquerade"}
+	if subnetV6 != nil {
+		rules = append(rules, "ip6 saddr "+subnetV6.String()+" oifname != \""+bridge+"\" masquerade")
+	}
+	return addFirewallRules("postrouting", comment, rules...)
+}
+
+// TeardownBridgeNAT removes masquerade of the bridge, and restores forwarding when no bridge needs it
+func TeardownBridgeNAT(bridge string) error {
+	if err := deleteFirewallRules(getNATRuleComment(bridge)); err != nil {
+		return err
+	}
+
+	//Comment of other bridges only shares the prefix
+	if len(getFirewallRuleComments(natRuleCommentPrefix)) > 0 {
+		return nil
+	}
+	for _, forwardPath := range []string{ipForwardPath, ipv6ForwardPath} {
+		if err := restoreIPForward(forwardPath); err != nil {
+			log.Printf("Failed to restore forwarding %s: %v\n", forwardPath, err)
+			return err
+		}
+	}
+
+	return nil
+}
@@ -2,50 +2,20 @@ package network
 
 import (
 	"crypto/rand"
-	"fmt"
+	"go-docker/state"
 	"go-docker/utils"
 	"log"
-	mathRand "math/rand"
 	"net"
+	"strconv"
 
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
 )
 
 const defaultBrige string = "br0"
-const bridgeIpAddress = "172.29.0.1/16"
-
-func IsDockerBridgeUp() (bool, error) {
-	if links, err := netlink.LinkList(); err != nil {
-		log.Printf("Failed to get list of network links\n")
-		return false, err
-	} else {
-		for _, link := range links {
-			if link.Type() == "bridge" && link.Attrs().Name == defaultBrige {
-				return true, nil
-			}
-		}
-
-		return false, err
-	}
-}
-
-func SetupNetworkBridge() error {
-	linkAttrs := netlink.NewLinkAttrs()
-	linkAttrs.Name = defaultBrige
-	dockerBridge := &netlink.Bridge{LinkAttrs: linkAttrs}
-
-	if err := netlink.LinkAdd(dockerBridge); err != nil {
-		return err
-	}
-
-	address, _ := netlink.ParseAddr(bridgeIpAddress)
-	netlink.AddrAdd(dockerBridge, address)
-	netlink.LinkSetUp(dockerBridge)
-	return nil
-}
 
-func createMACAddress() net.HardwareAddr {
+// CreateMACAddress returns a random locally administered MAC address
+func CreateMACAddress() net.HardwareAddr {
 	hw := make(net.HardwareAddr, 6)
 	hw[0] = 0x02
 	hw[1] = 0x42
@@ -54,25 +24,62 @@ func createMACAddress() net.HardwareAddr {
 	return hw
 }
 
-func SetupVirtualEthOnHost(containerId string) error {
-	veth0 := "veth0_" + containerId[:6]
-	veth1 := "veth1_" + containerId[:6]
+// GetVethNames returns names of host side and container side of the virtual ethernet pair,
+// index tells endpoints of a container attached to several networks apart
+func GetVethNames(containerId string, index int) (string, string) {
+	suffix := containerId[:6]
+	if index > 0 {
+		suffix += "_" + strconv.Itoa(index)
+	}
+
+	return "veth0_" + suffix, "veth1_" + suffix
+}
+
+// SetupVirtualEthOnHost creates veth pair of an endpoint, host side is attached to the bridge of network
+func SetupVirtualEthOnHost(endpoint *state.Endpoint, bridge string) error {
 	linkAttrs := netlink.NewLinkAttrs()
-	linkAttrs.Name = veth0
+	linkAttrs.Name = endpoint.HostVeth
+	mac, err := net.ParseMAC(endpoint.MacAddress)
+	if err != nil {
+		return err
+	}
 	veth0Struct := &netlink.Veth{
 		LinkAttrs:        linkAttrs,
-		PeerName:         veth1,
-		PeerHardwareAddr: createMACAddress(),
+		PeerName:         endpoint.ContainerVeth,
+		PeerHardwareAddr: mac,
 	}
 
 	if err := netlink.LinkAdd(veth0Struct); err != nil {
 		return err
 	}
-	netlink.LinkSetUp(veth0Struct)
-	dockerBridge, _ := netlink.LinkByName(defaultBrige)
-	netlink.LinkSetMaster(veth0Struct, dockerBridge)
+	dockerBridge, err := netlink.LinkByName(bridge)
+	if err != nil {
+		netlink.LinkDel(veth0Struct)
+		return err
+	}
+	if err := netlink.LinkSetMaster(veth0Struct, dockerBridge); err != nil {
+		netlink.LinkDel(veth0Struct)
+		return err
+	}
 
-	return nil
+	return netlink.LinkSetUp(veth0Struct)
+}
+
+// DeleteVirtualEth deletes host side of veth pair, which removes the container side as well
+func DeleteVirtualEth(hostVeth string) error {
+	link, err := netlink.LinkByName(hostVeth)
+	if err != nil {
+		//Already gone with network namespace of the container
+		return nil
+	}
+
+	return netlink.LinkDel(link)
+}
+
+// LinkExists checks if a link with the name exists in network namespace of host
+func LinkExists(name string) bool {
+	_, err := netlink.LinkByName(name)
+	return err == nil
 }
 
 func JoinContainerNetworkNamespace(containerId string) error {
@@ -95,9 +102,11 @@ func SetupLocalInterface() {
 	links, _ := netlink.LinkList()
 	for _, link := range links {
 		if link.Attrs().Name == "lo" {
-			loAddr, _ := netlink.ParseAddr("127.0.0.1/32")
-			if err := netlink.AddrAdd(link, loAddr); err != nil {
-				log.Printf("Failed to configure local interface: %v\n", err)
+			for _, address := range []string{"127.0.0.1/32", "::1/128"} {
+				loAddr, _ := netlink.ParseAddr(address)
+				if err := netlink.AddrAdd(link, loAddr); err != nil && err != unix.EEXIST {
+					log.Printf("Failed to configure local interface: %v\n", err)
+				}
 			}
 			netlink.LinkSetUp(link)
 		}
@@ -129,14 +138,10 @@ func SetupNewNetworkNamespace(containerId string) {
 	}
 }
 
-func createPrivateIPAddress() string {
-	byte1 := mathRand.Intn(254)
-	byte2 := mathRand.Intn(254)
-
-	return fmt.Sprintf("172,29,%d.%d", byte1, byte2)
-}
-
-func SetupContainerNetworkInterface(containerId string) {
+// SetupContainerNetworkInterface moves container side of veth pair into network namespace of container
+// and configures its addresses, IPv6 ones are empty if IPv6 is not enabled. Default routes go via
+// gateways if they are not empty
+func SetupContainerNetworkInterface(containerId string, containerVeth string, address string, gateway string, addressV6 string, gatewayV6 string) {
 	nsMount := utils.GetDockerNetNsPath() + "/" + containerId
 	fd, err := unix.Open(nsMount, unix.O_RDONLY, 0)
 	defer unix.Close(fd)
@@ -145,40 +150,56 @@ func SetupContainerNetworkInterface(containerId string) {
 		log.Fatalf("Failed to open network mount file: %v\n", err)
 	}
 
-	//Set container veth1 to new network namespace
-	veth1 := "veth1" + containerId[:6]
-	veth1Link, err := netlink.LinkByName(veth1)
+	//Set container veth to new network namespace
+	vethLink, err := netlink.LinkByName(containerVeth)
 	if err != nil {
-		log.Fatalf("Failed to fetch veth1: %v\n", err)
+		log.Fatalf("Failed to fetch %s: %v\n", containerVeth, err)
 	}
-	if err := netlink.LinkSetNsFd(veth1Link, fd); err != nil {
-		log.Fatalf("Failed to set network namespace for veth1: %v\n", err)
+	if err := netlink.LinkSetNsFd(vethLink, fd); err != nil {
+		log.Fatalf("Failed to set network namespace for %s: %v\n", containerVeth, err)
 	}
 
 	if err := unix.Setns(fd, unix.CLONE_NEWNET); err != nil {
 		log.Fatalf("Failed to set network: %v\n", err)
 	}
 
-	addr, _ := netlink.ParseAddr(createPrivateIPAddress() + "/16")
-	if err := netlink.AddrAdd(veth1Link, addr); err != nil {
-		log.Fatalf("Failed to assign IP to veth1: %v\n", err)
+	addr, err := netlink.ParseAddr(address)
+	if err != nil {
+		log.Fatalf("Invalid address %s: %v\n", address, err)
 	}
-
-	//Activate veth1 interface
-	if err := netlink.LinkSetUp(veth1Link); err != nil {
-		log.Fatalf("Failed to activate veth1: %v\n", err)
+	if err := netlink.AddrAdd(vethLink, addr); err != nil {
+		log.Fatalf("Failed to assign IP to %s: %v\n", containerVeth, err)
+	}
+	if addressV6 != "" {
+		addr, err := netlink.ParseAddr(addressV6)
+		if err != nil {
+			log.Fatalf("Invalid address %s: %v\n", addressV6, err)
+		}
+		//Skip duplicate address detection, addresses are unique as they are leased by IPAM
+		addr.Flags = unix.IFA_F_NODAD
+		if err := netlink.AddrAdd(vethLink, addr); err != nil {
+			log.Fatalf("Failed to assign IPv6 address to %s: %v\n", containerVeth, err)
+		}
 	}
 
-	//Add a default route
-	const defaultGateway = "172.29.0.1"
-	route := netlink.Route{
-		Scope:     netlink.SCOPE_UNIVERSE,
-		LinkIndex: veth1Link.Attrs().Index,
-		Gw:        net.ParseIP(defaultGateway),
-		Dst:       nil,
+	//Activate veth interface
+	if err := netlink.LinkSetUp(vethLink); err != nil {
+		log.Fatalf("Failed to activate %s: %v\n", containerVeth, err)
 	}
 
-	if err := netlink.RouteAdd(&route); err != nil {
-		log.Fatalf("Failed to add default route: %v\n", err)
+	//Add default routes
+	for _, gw := range []string{gateway, gatewayV6} {
+		if gw == "" {
+			continue
+		}
+		route := netlink.Route{
+			Scope:     netlink.SCOPE_UNIVERSE,
+			LinkIndex: vethLink.Attrs().Index,
+			Gw:        net.ParseIP(gw),
+			Dst:       nil,
+		}
+		if err := netlink.RouteAdd(&route); err != nil {
+			log.Fatalf("Failed to add default route via %s: %v\n", gw, err)
+		}
 	}
 }
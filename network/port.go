@@ -0,0 +1,346 @@
+package network
+
+import (
+	"fmt"
+	"go-docker/state"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Idle time after which a UDP flow of userland proxy is dropped
+const udpProxyTimeout = 90 * time.Second
+
+// Prefix of comments tagging DNAT rules of published ports of containers
+const portRuleCommentPrefix = "go-docker:container:"
+
+func getPortRuleComment(containerId string) string {
+	return portRuleCommentPrefix + containerId
+}
+
+func parsePort(port string) (int, error) {
+	value, err := strconv.Atoi(port)
+	if err != nil || value <= 0 || value > 65535 {
+		return 0, fmt.Errorf("invalid port %s", port)
+	}
+
+	return value, nil
+}
+
+// ParsePortSpec parses -p option [hostIP:]hostPort:containerPort[/tcp|udp], IPv6 host IP is given in brackets
+func ParsePortSpec(spec string) (state.PortBinding, error) {
+	binding := state.PortBinding{HostIP: "0.0.0.0", Protocol: "tcp"}
+
+	ports, protocol, hasProtocol := strings.Cut(spec, "/")
+	if hasProtocol {
+		if protocol != "tcp" && protocol != "udp" {
+			return binding, fmt.Errorf("unsupported protocol %s of port %s", protocol, spec)
+		}
+		binding.Protocol = protocol
+	}
+
+	var err error
+	hostIP := ""
+	if strings.HasPrefix(ports, "[") {
+		var found bool
+		if hostIP, ports, found = strings.Cut(ports[1:], "]:"); !found {
+			return binding, fmt.Errorf("invalid host IP of port %s", spec)
+		}
+		if ip := net.ParseIP(hostIP); ip == nil || ip.To4() != nil {
+			return binding, fmt.Errorf("invalid host IP %s of port %s", hostIP, spec)
+		}
+	}
+	parts := strings.Split(ports, ":")
+	if hostIP != "" {
+		parts = append([]string{hostIP}, parts...)
+	}
+	switch len(parts) {
+	case 3:
+		if ip := net.ParseIP(parts[0]); ip == nil || (hostIP == "" && ip.To4() == nil) {
+			return binding, fmt.Errorf("invalid host IP %s of port %s", parts[0], spec)
+		}
+		binding.HostIP = parts[0]
+		parts = parts[1:]
+		fallthrough
+	case 2:
+		if binding.HostPort, err = parsePort(parts[0]); err != nil {
+			return binding, err
+		}
+		if binding.ContainerPort, err = parsePort(parts[1]); err != nil {
+			return binding, err
+		}
+	default:
+		return binding, fmt.Errorf("invalid port %s, expect [hostIP:]hostPort:containerPort[/tcp|udp]", spec)
+	}
+
+	return binding, nil
+}
+
+// getDNATRule forwards traffic to published host port to the container, except traffic from the bridge
+// of container itself, as container to host traffic is served by userland proxy
+func getDNATRule(binding *state.PortBinding, bridge string, containerIP string) string {
+	if isIPv6Binding(binding) {
+		match := "meta nfproto ipv6"
+		if binding.HostIP != "::" {
+			match = "ip6 daddr " + binding.HostIP
+		}
+		return fmt.Sprintf("iifname != \"%s\" %s %s dport %d dnat ip6 to [%s]:%d",
+			bridge, match, binding.Protocol, binding.HostPort, containerIP, binding.ContainerPort)
+	}
+
+	match := "meta nfproto ipv4"
+	if binding.HostIP != "0.0.0.0" {
+		match = "ip daddr " + binding.HostIP
+	}
+
+	return fmt.Sprintf("iifname != \"%s\" %s %s dport %d dnat ip to %s:%d",
+		bridge, match, binding.Protocol, binding.HostPort, containerIP, binding.ContainerPort)
+}
+
+func isIPv6Binding(binding *state.PortBinding) bool {
+	return net.ParseIP(binding.HostIP).To4() == nil
+}
+
+// listenHostPort binds host port in current process, so conflicts are found before the proxy is started
+func listenHostPort(binding *state.PortBinding) (*os.File, error) {
+	address := net.JoinHostPort(binding.HostIP, strconv.Itoa(binding.HostPort))
+	//IPv6 sockets are bound as v6 only, so they never conflict with the IPv4 binding of the same port
+	family := "4"
+	if isIPv6Binding(binding) {
+		family = "6"
+	}
+	if binding.Protocol == "udp" {
+		conn, err := net.ListenPacket("udp"+family, address)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return conn.(*net.UDPConn).File()
+	}
+
+	listener, err := net.Listen("tcp"+family, address)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+	return listener.(*net.TCPListener).File()
+}
+
+func startPortProxy(binding *state.PortBinding, containerIP string) (int, error) {
+	listenerFile, err := listenHostPort(binding)
+	if err != nil {
+		return 0, err
+	}
+	defer listenerFile.Close()
+
+	target := net.JoinHostPort(containerIP, strconv.Itoa(binding.ContainerPort))
+	cmd := exec.Command("/proc/self/exe", "port-proxy", binding.Protocol, target)
+	cmd.ExtraFiles = []*os.File{listenerFile}
+	cmd.SysProcAttr = &unix.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+
+	return pid, nil
+}
+
+// hasBinding checks if ports has a binding of the same host address, port and protocol
+func hasBinding(ports []state.PortBinding, binding *state.PortBinding) bool {
+	for _, port := range ports {
+		if port.HostIP == binding.HostIP && port.HostPort == binding.HostPort && port.Protocol == binding.Protocol {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PublishPorts starts userland proxies and installs DNAT rules for published ports of a container,
+// containerIPv6 is empty if container has no IPv6 address. Ports published on all addresses are
+// published on IPv6 as well if container has IPv6 address. Returned bindings are a new slice with
+// pids of the proxies, ports given are left as they are, so bindings returned before can be given again
+func PublishPorts(containerId string, bridge string, containerIP string, containerIPv6 string, ports []state.PortBinding) ([]state.PortBinding, error) {
+	published := make([]state.PortBinding, 0, len(ports))
+	for _, binding := range ports {
+		binding.ProxyPid = 0
+		published = append(published, binding)
+	}
+	if containerIPv6 != "" {
+		for _, binding := range ports {
+			binding.ProxyPid = 0
+			if binding.HostIP == "0.0.0.0" {
+				binding.HostIP = "::"
+				if !hasBinding(published, &binding) {
+					published = append(published, binding)
+				}
+			}
+		}
+	}
+
+	var rules []string
+	for i := range published {
+		targetIP := containerIP
+		if isIPv6Binding(&published[i]) {
+			if containerIPv6 == "" {
+				UnpublishPorts(containerId, published[:i])
+				return nil, fmt.Errorf("port %s is IPv6 but container has no IPv6 address", published[i].String())
+			}
+			targetIP = containerIPv6
+		}
+		pid, err := startPortProxy(&published[i], targetIP)
+		if err != nil {
+			UnpublishPorts(containerId, published[:i])
+			return nil, fmt.Errorf("failed to bind port %s: %w", published[i].String(), err)
+		}
+		published[i].ProxyPid = pid
+		rules = append(rules, getDNATRule(&published[i], bridge, targetIP))
+	}
+
+	if len(rules) > 0 {
+		if err := addFirewallRules("publish", getPortRuleComment(containerId), rules...); err != nil {
+			UnpublishPorts(containerId, published)
+			return nil, err
+		}
+	}
+
+	return published, nil
+}
+
+// isPortProxy checks if pid is still a userland proxy, pid recorded before a reboot may belong to anything now
+func isPortProxy(pid int) bool {
+	cmdline, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/cmdline")
+	if err != nil {
+		return false
+	}
+	args := strings.Split(string(cmdline), "\x00")
+
+	return len(args) > 1 && args[1] == "port-proxy"
+}
+
+// UnpublishPorts removes DNAT rules and stops userland proxies of a container
+func UnpublishPorts(containerId string, ports []state.PortBinding) {
+	if err := deleteFirewallRules(getPortRuleComment(containerId)); err != nil {
+		log.Printf("Failed to delete port rules of container %s: %v\n", containerId, err)
+	}
+
+	for _, binding := range ports {
+		if binding.ProxyPid <= 0 || !isPortProxy(binding.ProxyPid) {
+			continue
+		}
+		if err := unix.Kill(binding.ProxyPid, unix.SIGTERM); err != nil && err != unix.ESRCH {
+			log.Printf("Failed to stop proxy of port %s: %v\n", binding.String(), err)
+		}
+	}
+}
+
+func proxyTCPConn(conn net.Conn, target string) {
+	defer conn.Close()
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		log.Printf("Failed to connect to %s: %v\n", target, err)
+		return
+	}
+	defer upstream.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyStream := func(dst net.Conn, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		//Half close, so the other side sees EOF but can still send data
+		if tcpConn, ok := dst.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+	}
+	go copyStream(upstream, conn)
+	go copyStream(conn, upstream)
+	wg.Wait()
+}
+
+func runTCPProxy(listenerFile *os.File, target string) {
+	listener, err := net.FileListener(listenerFile)
+	if err != nil {
+		log.Fatalf("Failed to open proxy listener: %v\n", err)
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatalf("Failed to accept connection: %v\n", err)
+		}
+		go proxyTCPConn(conn, target)
+	}
+}
+
+func runUDPProxy(listenerFile *os.File, target string) {
+	conn, err := net.FilePacketConn(listenerFile)
+	if err != nil {
+		log.Fatalf("Failed to open proxy socket: %v\n", err)
+	}
+	targetAddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		log.Fatalf("Invalid proxy target %s: %v\n", target, err)
+	}
+
+	var mu sync.Mutex
+	flows := map[string]*net.UDPConn{}
+	buf := make([]byte, 65535)
+	for {
+		n, clientAddr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Fatalf("Failed to read from proxy socket: %v\n", err)
+		}
+
+		mu.Lock()
+		upstream, found := flows[clientAddr.String()]
+		if !found {
+			if upstream, err = net.DialUDP("udp", nil, targetAddr); err != nil {
+				mu.Unlock()
+				log.Printf("Failed to connect to %s: %v\n", target, err)
+				continue
+			}
+			flows[clientAddr.String()] = upstream
+
+			//Relay replies back to client until the flow is idle
+			go func(upstream *net.UDPConn, clientAddr net.Addr) {
+				replyBuf := make([]byte, 65535)
+				for {
+					upstream.SetReadDeadline(time.Now().Add(udpProxyTimeout))
+					n, err := upstream.Read(replyBuf)
+					if err != nil {
+						break
+					}
+					conn.WriteTo(replyBuf[:n], clientAddr)
+				}
+				mu.Lock()
+				delete(flows, clientAddr.String())
+				mu.Unlock()
+				upstream.Close()
+			}(upstream, clientAddr)
+		}
+		mu.Unlock()
+
+		upstream.Write(buf[:n])
+	}
+}
+
+// RunPortProxy serves traffic which can't be handled by DNAT, like host local or hairpin traffic,
+// listener socket is bound by the parent and passed as fd 3
+func RunPortProxy(protocol string, target string) {
+	listenerFile := os.NewFile(3, "listener")
+	if protocol == "udp" {
+		runUDPProxy(listenerFile, target)
+	} else {
+		runTCPProxy(listenerFile, target)
+	}
+}
@@ -0,0 +1,195 @@
+package network
+
+import (
+	"fmt"
+	"go-docker/utils"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Names of links created by GetVethNames, the group is the first 6 characters of container ID
+var vethNamePattern = regexp.MustCompile(`^veth[01]_([0-9a-f]{6})(_\d+)?$`)
+
+// hasContainerWithPrefix checks if ID of any container starts with prefix
+func hasContainerWithPrefix(containerIds map[string]bool, prefix string) bool {
+	for containerId := range containerIds {
+		if strings.HasPrefix(containerId, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PruneLinks deletes veth pairs and macvlan/ipvlan links on host whose container is gone. Links only
+// carry 6 characters of container ID, so a link is kept while any container shares them
+func PruneLinks(containerIds map[string]bool, dryRun bool) ([]string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, link := range links {
+		name := link.Attrs().Name
+		match := vethNamePattern.FindStringSubmatch(name)
+		if match == nil || hasContainerWithPrefix(containerIds, match[1]) {
+			continue
+		}
+		if !dryRun {
+			//Deleting one side of a veth pair deletes its peer too
+			if err := netlink.LinkDel(link); err != nil && err != unix.ENODEV {
+				return removed, fmt.Errorf("failed to delete link %s: %w", name, err)
+			}
+		}
+		removed = append(removed, name)
+	}
+
+	return removed, nil
+}
+
+// RemoveNetworkNamespace unmounts network namespace file of a container and removes it,
+// namespace file which is not mounted or already removed is fine
+func RemoveNetworkNamespace(containerId string) error {
+	nsMount := utils.GetDockerNetNsPath() + "/" + containerId
+	if err := unix.Unmount(nsMount, unix.MNT_DETACH); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return fmt.Errorf("failed to unmount network namespace %s: %w", nsMount, err)
+	}
+	if err := os.Remove(nsMount); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// PruneNetworkNamespaces removes network namespace files of containers which are gone
+func PruneNetworkNamespaces(containerIds map[string]bool, dryRun bool) ([]string, error) {
+	entries, err := os.ReadDir(utils.GetDockerNetNsPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, entry := range entries {
+		if entry.IsDir() || containerIds[entry.Name()] {
+			continue
+		}
+		if !dryRun {
+			if err := RemoveNetworkNamespace(entry.Name()); err != nil {
+				return removed, err
+			}
+		}
+		removed = append(removed, entry.Name())
+	}
+
+	return removed, nil
+}
+
+// PruneLeases releases addresses leased to containers which are gone, and removes pools of networks
+// which were removed. Entries are returned as network/address
+func PruneLeases(containerIds map[string]bool, dryRun bool) ([]string, error) {
+	entries, err := os.ReadDir(getIPAMPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ".json")
+		if _, err := loadNetwork(name); err != nil && name != DefaultNetworkName {
+			if !dryRun {
+				if err := removePool(name); err != nil {
+					return removed, err
+				}
+			}
+			removed = append(removed, name+"/*")
+			continue
+		}
+
+		var stale []string
+		err := withPool(name, func(pool *Pool) error {
+			for address, owner := range pool.Leases {
+				if !containerIds[owner] {
+					stale = append(stale, address)
+				}
+			}
+			if dryRun {
+				return nil
+			}
+			for _, address := range stale {
+				delete(pool.Leases, address)
+			}
+			return nil
+		})
+		if err != nil {
+			return removed, err
+		}
+		sort.Strings(stale)
+		for _, address := range stale {
+			removed = append(removed, name+"/"+address)
+		}
+	}
+
+	return removed, nil
+}
+
+// PruneFirewallRules deletes port and egress rules of containers which are gone, entries are rule comments
+func PruneFirewallRules(containerIds map[string]bool, dryRun bool) ([]string, error) {
+	var removed []string
+	for _, prefix := range []string{portRuleCommentPrefix, egressRuleCommentPrefix} {
+		for _, comment := range getFirewallRuleComments(prefix) {
+			if containerIds[strings.TrimPrefix(comment, prefix)] {
+				continue
+			}
+			if !dryRun {
+				if err := deleteFirewallRules(comment); err != nil {
+					return removed, err
+				}
+			}
+			removed = append(removed, comment)
+		}
+	}
+
+	return removed, nil
+}
+
+// PruneCNIResults removes cached results of CNI plugins of containers which are gone. DEL can't be run
+// for them as results don't tell which network they belong to
+func PruneCNIResults(containerIds map[string]bool, dryRun bool) ([]string, error) {
+	dir := filepath.Dir(getCNIResultPath("", ""))
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, entry := range entries {
+		containerId, _, _ := strings.Cut(entry.Name(), "-")
+		if entry.IsDir() || containerIds[containerId] {
+			continue
+		}
+		if !dryRun {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return removed, err
+			}
+		}
+		removed = append(removed, entry.Name())
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,142 @@
+package network
+
+import (
+	"fmt"
+	"go-docker/state"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Rate units like tc, bare number is bits per second
+var rateUnits = []struct {
+	suffix string
+	bits   float64
+}{
+	{"tbit", 1e12}, {"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1},
+	{"tbps", 8e12}, {"gbps", 8e9}, {"mbps", 8e6}, {"kbps", 8e3}, {"bps", 8},
+}
+
+// Time packets may wait in token bucket before dropped, same as the usual tc examples
+const shapingLatency = 50 * time.Millisecond
+
+// Smallest burst of token bucket, it has to hold at least one full frame
+const minShapingBurst = 3028
+
+// ParseRate parses rate like 1mbit or 100kbps, and returns it in bytes per second
+func ParseRate(rate string) (uint64, error) {
+	number := strings.ToLower(strings.TrimSpace(rate))
+	if number == "" {
+		return 0, nil
+	}
+
+	bits := float64(1)
+	for _, unit := range rateUnits {
+		if value, found := strings.CutSuffix(number, unit.suffix); found {
+			number, bits = value, unit.bits
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid rate %s", rate)
+	}
+
+	return uint64(value * bits / 8), nil
+}
+
+// ParseLoss parses loss percentage like 1.5 or 1.5%
+func ParseLoss(loss string) (float64, error) {
+	loss = strings.TrimSuffix(strings.TrimSpace(loss), "%")
+	if loss == "" {
+		return 0, nil
+	}
+	value, err := strconv.ParseFloat(loss, 64)
+	if err != nil || value < 0 || value > 100 {
+		return 0, fmt.Errorf("invalid loss %s, it must be a percentage between 0 and 100", loss)
+	}
+
+	return value, nil
+}
+
+// getShapingBurst returns burst of token bucket, about 10ms of traffic unless it is given
+func getShapingBurst(shaping *state.Shaping) uint64 {
+	if shaping.Burst > 0 {
+		return shaping.Burst
+	}
+
+	return max(shaping.Rate/100, minShapingBurst)
+}
+
+// deleteRootQdisc removes the root qdisc of link, kernel puts back the default one
+func deleteRootQdisc(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return err
+	}
+	for _, qdisc := range qdiscs {
+		attrs := qdisc.Attrs()
+		if attrs.Parent != netlink.HANDLE_ROOT || (qdisc.Type() != "tbf" && qdisc.Type() != "netem") {
+			continue
+		}
+		if err := netlink.QdiscDel(qdisc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ApplyShaping replaces qdiscs of the host side veth with the shaping: netem for delay and loss at root,
+// with tbf below it for rate, or tbf alone at root. As qdiscs work on egress, it limits traffic to container
+func ApplyShaping(hostVeth string, shaping *state.Shaping) error {
+	link, err := netlink.LinkByName(hostVeth)
+	if err != nil {
+		return err
+	}
+	if err := deleteRootQdisc(link); err != nil {
+		return err
+	}
+	if shaping.IsEmpty() {
+		return nil
+	}
+
+	tbfParent := uint32(netlink.HANDLE_ROOT)
+	if shaping.Delay > 0 || shaping.Loss > 0 {
+		netem := netlink.NewNetem(netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		}, netlink.NetemQdiscAttrs{
+			Latency: uint32(shaping.Delay.Microseconds()),
+			Loss:    float32(shaping.Loss),
+		})
+		if err := netlink.QdiscAdd(netem); err != nil {
+			return fmt.Errorf("failed to add netem qdisc: %w", err)
+		}
+		tbfParent = netlink.MakeHandle(1, 1)
+	}
+	if shaping.Rate == 0 {
+		return nil
+	}
+
+	burst := getShapingBurst(shaping)
+	tbf := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(10, 0),
+			Parent:    tbfParent,
+		},
+		Rate:   shaping.Rate,
+		Limit:  uint32(float64(shaping.Rate)*shapingLatency.Seconds()) + uint32(burst),
+		Buffer: uint32(netlink.Xmittime(shaping.Rate, uint32(burst))),
+	}
+	if err := netlink.QdiscAdd(tbf); err != nil {
+		deleteRootQdisc(link)
+		return fmt.Errorf("failed to add tbf qdisc: %w", err)
+	}
+
+	return nil
+}
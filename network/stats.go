@@ -0,0 +1,102 @@
+package network
+
+import (
+	"go-docker/state"
+	"go-docker/utils"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// EndpointStats are counters of both sides of an endpoint, container side is missing if network namespace
+// of the container is gone and host side is missing for drivers without host link
+type EndpointStats struct {
+	Interface string
+	Container *state.InterfaceStats `json:",omitempty"`
+	HostVeth  string                `json:",omitempty"`
+	Host      *state.InterfaceStats `json:",omitempty"`
+}
+
+func getLinkStats(link netlink.Link) *state.InterfaceStats {
+	stats := link.Attrs().Statistics
+	if stats == nil {
+		return nil
+	}
+
+	return &state.InterfaceStats{
+		RxBytes:   stats.RxBytes,
+		RxPackets: stats.RxPackets,
+		RxErrors:  stats.RxErrors,
+		RxDropped: stats.RxDropped,
+		TxBytes:   stats.TxBytes,
+		TxPackets: stats.TxPackets,
+		TxErrors:  stats.TxErrors,
+		TxDropped: stats.TxDropped,
+	}
+}
+
+// readNamespaceStats reads counters of links inside network namespace of the container by link name
+func readNamespaceStats(containerId string) (map[string]*state.InterfaceStats, error) {
+	fd, err := unix.Open(utils.GetDockerNetNsPath()+"/"+containerId, unix.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+	handle, err := netlink.NewHandleAt(netns.NsHandle(fd))
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Delete()
+
+	links, err := handle.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	stats := map[string]*state.InterfaceStats{}
+	for _, link := range links {
+		if linkStats := getLinkStats(link); linkStats != nil {
+			stats[link.Attrs().Name] = linkStats
+		}
+	}
+
+	return stats, nil
+}
+
+// CollectContainerStats reads counters of all endpoints of a container by network name, and adds traffic
+// of container interfaces since last collection to running total kept in container state, which is returned
+func CollectContainerStats(containerId string) (map[string]*EndpointStats, *state.InterfaceStats, error) {
+	container, err := state.Load(containerId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//Namespace is gone with the container interfaces, only total is left then
+	namespaceStats, _ := readNamespaceStats(containerId)
+	stats := map[string]*EndpointStats{}
+	for name, endpoint := range container.Network.Networks {
+		endpointStats := &EndpointStats{
+			Interface: endpoint.ContainerVeth,
+			Container: namespaceStats[endpoint.ContainerVeth],
+			HostVeth:  endpoint.HostVeth,
+		}
+		if endpoint.HostVeth != "" {
+			if link, err := netlink.LinkByName(endpoint.HostVeth); err == nil {
+				endpointStats.Host = getLinkStats(link)
+			}
+		}
+		stats[name] = endpointStats
+	}
+
+	total := &state.InterfaceStats{}
+	err = state.Update(containerId, func(c *state.Container) {
+		for _, endpointStats := range stats {
+			if endpointStats.Container != nil {
+				c.Network.Stats.Update(endpointStats.Interface, endpointStats.Container)
+			}
+		}
+		*total = c.Network.Stats.Total
+	})
+
+	return stats, total, err
+}
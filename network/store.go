@@ -0,0 +1,511 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go-docker/state"
+	"go-docker/utils"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Name of the network containers are started on if no network is given
+const DefaultNetworkName = "bridge"
+
+// Network is a bridge with its own subnet, containers on different networks can't reach each other.
+// Networks of macvlan and ipvlan drivers put containers on the segment of a host interface instead
+type Network struct {
+	Name   string
+	Id     string
+	Driver string
+	//Bridge of bridge driver, empty for macvlan and ipvlan
+	Bridge string `json:",omitempty"`
+	//Host interface containers of macvlan and ipvlan networks sit on
+	Parent string `json:",omitempty"`
+	//Directories of config list and plugins of cni driver, defaults of CNI if empty
+	CNIConfDir string `json:",omitempty"`
+	CNIBinDir  string `json:",omitempty"`
+	//Containers on the bridge can't reach each other except through published ports
+	DisableICC bool `json:",omitempty"`
+	Subnet     string
+	Gateway    string
+	//IPv6 subnet and gateway, only set if IPv6 is enabled
+	EnableIPv6 bool
+	SubnetV6   string
+	GatewayV6  string
+	Created    time.Time
+}
+
+var validNetworkName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+func getNetworkStorePath() string {
+	return utils.GetDockerNetworkPath() + "/networks"
+}
+
+func getNetworkFilePath(name string) string {
+	return getNetworkStorePath() + "/" + name + ".json"
+}
+
+func createNetworkId() string {
+	randBytes := make([]byte, 32)
+	rand.Read(randBytes)
+
+	return hex.EncodeToString(randBytes)
+}
+
+func (nw *Network) getPrefix(subnetSpec string, gatewaySpec string) (netip.Prefix, netip.Addr, error) {
+	subnet, err := netip.ParsePrefix(subnetSpec)
+	if err != nil {
+		return subnet, netip.Addr{}, fmt.Errorf("invalid subnet %s of network %s", subnetSpec, nw.Name)
+	}
+	gateway, err := netip.ParseAddr(gatewaySpec)
+	if err != nil {
+		return subnet, gateway, fmt.Errorf("invalid gateway %s of network %s", gatewaySpec, nw.Name)
+	}
+
+	return subnet.Masked(), gateway, nil
+}
+
+// GetSubnetV6 returns IPv6 subnet and gateway address of the network, nil if IPv6 is not enabled
+func (nw *Network) GetSubnetV6() (*net.IPNet, net.IP, error) {
+	if !nw.EnableIPv6 {
+		return nil, nil, nil
+	}
+	_, subnet, err := net.ParseCIDR(nw.SubnetV6)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid subnet %s of network %s", nw.SubnetV6, nw.Name)
+	}
+
+	return subnet, net.ParseIP(nw.GatewayV6), nil
+}
+
+// GetSubnet returns subnet and gateway address of the network
+func (nw *Network) GetSubnet() (*net.IPNet, net.IP, error) {
+	_, subnet, err := net.ParseCIDR(nw.Subnet)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid subnet %s of network %s", nw.Subnet, nw.Name)
+	}
+	gateway := net.ParseIP(nw.Gateway)
+	if gateway == nil {
+		return nil, nil, fmt.Errorf("invalid gateway %s of network %s", nw.Gateway, nw.Name)
+	}
+
+	return subnet, gateway, nil
+}
+
+func saveNetwork(nw *Network) error {
+	if err := os.MkdirAll(getNetworkStorePath(), utils.File_OtherReadExecute); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(nw, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempPath := getNetworkFilePath(nw.Name) + ".tmp"
+	if err := os.WriteFile(tempPath, data, utils.File_OtherReadOnly); err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, getNetworkFilePath(nw.Name))
+}
+
+func loadNetwork(name string) (*Network, error) {
+	data, err := os.ReadFile(getNetworkFilePath(name))
+	if err != nil {
+		return nil, err
+	}
+
+	nw := &Network{}
+	if err := json.Unmarshal(data, nw); err != nil {
+		return nil, fmt.Errorf("failed to parse network %s: %w", name, err)
+	}
+
+	return nw, nil
+}
+
+// Get returns a network by name, ID or unique ID prefix. The default network is saved on first use
+func Get(nameOrId string) (*Network, error) {
+	if nw, err := loadNetwork(nameOrId); err == nil {
+		return nw, nil
+	}
+	if nameOrId == DefaultNetworkName {
+		nw := &Network{
+			Name:    DefaultNetworkName,
+			Id:      createNetworkId(),
+			Driver:  DriverBridge,
+			Bridge:  defaultBrige,
+			Subnet:  "172.29.0.0/16",
+			Gateway: "172.29.0.1",
+			Created: time.Now(),
+		}
+		return nw, saveNetwork(nw)
+	}
+
+	networks, err := List()
+	if err != nil {
+		return nil, err
+	}
+	var found *Network
+	for _, nw := range networks {
+		if nw.Id == nameOrId {
+			return nw, nil
+		}
+		if strings.HasPrefix(nw.Id, nameOrId) {
+			if found != nil {
+				return nil, fmt.Errorf("network ID prefix %s is ambiguous", nameOrId)
+			}
+			found = nw
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no such network %s", nameOrId)
+	}
+
+	return found, nil
+}
+
+// List returns all saved networks, the default network included once it was used
+func List() ([]*Network, error) {
+	var networks []*Network
+
+	entries, err := os.ReadDir(getNetworkStorePath())
+	if os.IsNotExist(err) {
+		return networks, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		name, isJson := strings.CutSuffix(entry.Name(), ".json")
+		if !isJson {
+			continue
+		}
+		if nw, err := loadNetwork(name); err == nil {
+			networks = append(networks, nw)
+		}
+	}
+
+	return networks, nil
+}
+
+// subnetInUse checks if subnet overlaps with another network, or with an address of the host if checkHost is set
+func subnetInUse(subnet *net.IPNet, networks []*Network, checkHost bool) bool {
+	overlaps := func(other *net.IPNet) bool {
+		return other.Contains(subnet.IP) || subnet.Contains(other.IP)
+	}
+
+	for _, nw := range networks {
+		if _, other, err := net.ParseCIDR(nw.Subnet); err == nil && overlaps(other) {
+			return true
+		}
+		if _, other, err := net.ParseCIDR(nw.SubnetV6); err == nil && overlaps(other) {
+			return true
+		}
+	}
+	if !checkHost {
+		return false
+	}
+	if addrs, err := netlink.AddrList(nil, netlink.FAMILY_ALL); err == nil {
+		for _, addr := range addrs {
+			if overlaps(addr.IPNet) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// findFreeSubnet picks the first /16 of 172.30-31 or /24 of 192.168 which is not used yet
+func findFreeSubnet(networks []*Network) (*net.IPNet, error) {
+	var candidates []string
+	for i := 30; i < 32; i++ {
+		candidates = append(candidates, fmt.Sprintf("172.%d.0.0/16", i))
+	}
+	for i := 0; i < 256; i++ {
+		candidates = append(candidates, fmt.Sprintf("192.168.%d.0/24", i))
+	}
+
+	for _, candidate := range candidates {
+		_, subnet, _ := net.ParseCIDR(candidate)
+		if !subnetInUse(subnet, networks, true) {
+			return subnet, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no free subnet left, give one with --subnet")
+}
+
+// CreateOptions are settings of a new network, empty ones are picked automatically
+type CreateOptions struct {
+	Driver string
+	//Host interface of macvlan and ipvlan networks
+	Parent string
+	//Directories of config list and plugins of cni networks
+	CNIConfDir string
+	CNIBinDir  string
+	DisableICC bool
+	Subnet     string
+	Gateway    string
+	EnableIPv6 bool
+	SubnetV6   string
+	GatewayV6  string
+}
+
+// parseSubnet validates subnet and gateway given for a new network, the gateway defaults to the first
+// address of the subnet. Subnet of a host segment overlaps addresses of host, checkHost is unset for it
+func parseSubnet(subnetSpec string, gatewaySpec string, isIPv6 bool, networks []*Network, checkHost bool) (*net.IPNet, net.IP, error) {
+	ip, subnet, err := net.ParseCIDR(subnetSpec)
+	if err != nil || (ip.To4() == nil) != isIPv6 {
+		return nil, nil, fmt.Errorf("invalid subnet %s", subnetSpec)
+	}
+	//Gateway and at least one container need addresses besides subnet and broadcast addresses
+	if ones, bits := subnet.Mask.Size(); bits-ones < 2 {
+		return nil, nil, fmt.Errorf("subnet %s is too small, prefix must be /%d or shorter", subnetSpec, bits-2)
+	}
+	if subnetInUse(subnet, networks, checkHost) {
+		return nil, nil, fmt.Errorf("subnet %s overlaps with an existing network or host address", subnetSpec)
+	}
+
+	prefix, _ := netip.ParsePrefix(subnet.String())
+	gateway, _, err := getHostRange(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	if gatewaySpec != "" {
+		if gateway, err = netip.ParseAddr(gatewaySpec); err != nil || !prefix.Contains(gateway) {
+			return nil, nil, fmt.Errorf("gateway %s is not in subnet %s", gatewaySpec, subnet.String())
+		}
+		if !isHostAddress(prefix, gateway) {
+			return nil, nil, fmt.Errorf("gateway %s is reserved", gatewaySpec)
+		}
+	}
+
+	return subnet, gateway.AsSlice(), nil
+}
+
+// createULASubnet returns a random /64 of unique local addresses fd00::/8
+func createULASubnet() string {
+	globalId := make([]byte, 5)
+	rand.Read(globalId)
+
+	return fmt.Sprintf("fd%02x:%02x%02x:%02x%02x::/64", globalId[0], globalId[1], globalId[2], globalId[3], globalId[4])
+}
+
+// Create saves a new network, subnet of a bridge network is picked automatically if not given and the
+// gateway defaults to the first address of the subnet. The bridge itself is created when it is first used
+func Create(name string, opts *CreateOptions) (*Network, error) {
+	if !validNetworkName.MatchString(name) {
+		return nil, fmt.Errorf("invalid network name %s, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+	driver := opts.Driver
+	if driver == "" {
+		driver = DriverBridge
+	}
+	if _, err := GetDriver(driver); err != nil {
+		return nil, err
+	}
+	if driver == DriverBridge && opts.Parent != "" {
+		return nil, fmt.Errorf("parent interface can't be given to %s network", driver)
+	}
+	if driver != DriverBridge && opts.DisableICC {
+		return nil, fmt.Errorf("inter-container communication can only be disabled on %s network", DriverBridge)
+	}
+	if driver != DriverCNI && (opts.CNIConfDir != "" || opts.CNIBinDir != "") {
+		return nil, fmt.Errorf("CNI directories can't be given to %s network", driver)
+	}
+	if driver != DriverBridge && driver != DriverCNI {
+		//Containers get addresses of the host segment, which can't be guessed
+		if opts.Parent == "" || opts.Subnet == "" {
+			return nil, fmt.Errorf("%s network needs parent interface and subnet", driver)
+		}
+		if _, err := netlink.LinkByName(opts.Parent); err != nil {
+			return nil, fmt.Errorf("parent interface %s not found: %w", opts.Parent, err)
+		}
+	}
+	if name == DefaultNetworkName || name == state.NetworkModeNone || name == state.NetworkModeHost {
+		return nil, fmt.Errorf("network %s is predefined", name)
+	}
+	if _, err := loadNetwork(name); err == nil {
+		return nil, fmt.Errorf("network %s already exists", name)
+	}
+	if driver == DriverCNI {
+		return createCNINetwork(name, opts)
+	}
+	if !opts.EnableIPv6 && (opts.SubnetV6 != "" || opts.GatewayV6 != "") {
+		return nil, fmt.Errorf("IPv6 subnet is given but IPv6 is not enabled")
+	}
+	//Make sure the default subnet is known, so it is never picked for another network
+	if _, err := Get(DefaultNetworkName); err != nil {
+		return nil, err
+	}
+
+	networks, err := List()
+	if err != nil {
+		return nil, err
+	}
+	subnetSpec := opts.Subnet
+	if subnetSpec == "" {
+		subnet, err := findFreeSubnet(networks)
+		if err != nil {
+			return nil, err
+		}
+		subnetSpec = subnet.String()
+	}
+	subnet, gateway, err := parseSubnet(subnetSpec, opts.Gateway, false, networks, driver == DriverBridge)
+	if err != nil {
+		return nil, err
+	}
+
+	id := createNetworkId()
+	nw := &Network{
+		Name:    name,
+		Id:      id,
+		Driver:  driver,
+		Subnet:  subnet.String(),
+		Gateway: gateway.String(),
+		Created: time.Now(),
+	}
+	if driver == DriverBridge {
+		nw.Bridge = "br-" + id[:12]
+		nw.DisableICC = opts.DisableICC
+	} else {
+		nw.Parent = opts.Parent
+	}
+
+	if opts.EnableIPv6 {
+		subnetSpec := opts.SubnetV6
+		if subnetSpec == "" {
+			subnetSpec = createULASubnet()
+		}
+		subnetV6, gatewayV6, err := parseSubnet(subnetSpec, opts.GatewayV6, true, networks, driver == DriverBridge)
+		if err != nil {
+			return nil, err
+		}
+		nw.EnableIPv6 = true
+		nw.SubnetV6 = subnetV6.String()
+		nw.GatewayV6 = gatewayV6.String()
+	}
+
+	return nw, saveNetwork(nw)
+}
+
+// createCNINetwork saves a network whose containers are set up by plugins of the CNI config list of
+// the same name, plugins take care of addresses so no subnet is kept
+func createCNINetwork(name string, opts *CreateOptions) (*Network, error) {
+	if opts.Parent != "" || opts.Subnet != "" || opts.Gateway != "" || opts.EnableIPv6 || opts.SubnetV6 != "" || opts.GatewayV6 != "" {
+		return nil, fmt.Errorf("addresses of %s network are configured in its CNI config", DriverCNI)
+	}
+
+	nw := &Network{
+		Name:       name,
+		Id:         createNetworkId(),
+		Driver:     DriverCNI,
+		CNIConfDir: opts.CNIConfDir,
+		CNIBinDir:  opts.CNIBinDir,
+		Created:    time.Now(),
+	}
+	if _, err := loadCNIConfList(nw.getCNIConfDir(), name); err != nil {
+		return nil, err
+	}
+
+	return nw, saveNetwork(nw)
+}
+
+// GetUsers returns IDs of containers which have an endpoint on the network, stopped containers included
+func GetUsers(nw *Network) ([]string, error) {
+	var users []string
+
+	containers, err := state.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range containers {
+		if _, found := c.Network.Networks[nw.Name]; found {
+			users = append(users, c.Id)
+		}
+	}
+
+	return users, nil
+}
+
+// Remove deletes a network which is not used by any container, along with its bridge and rules
+func Remove(nameOrId string) error {
+	nw, err := Get(nameOrId)
+	if err != nil {
+		return err
+	}
+	if nw.Name == DefaultNetworkName {
+		return fmt.Errorf("network %s is predefined and can't be removed", nw.Name)
+	}
+
+	users, err := GetUsers(nw)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("network %s is in use by container %s", nw.Name, strings.Join(users, ", "))
+	}
+
+	driver, err := nw.GetDriver()
+	if err != nil {
+		return err
+	}
+	if err := driver.Teardown(nw); err != nil {
+		return err
+	}
+	if err := removePool(nw.Name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Remove(getNetworkFilePath(nw.Name))
+}
+
+func PrintNetworks() {
+	networks, err := List()
+	if err != nil {
+		log.Fatalf("Failed to list networks: %v\n", err)
+	}
+
+	fmt.Println("NETWORK ID\tNAME\tDRIVER\tSUBNET")
+	for _, nw := range networks {
+		fmt.Printf("%s\t%s\t%s\t%s\n", nw.Id[:12], nw.Name, nw.Driver, nw.Subnet)
+	}
+}
+
+// InspectNetwork prints network with endpoints of containers attached to it as JSON
+func InspectNetwork(nameOrId string) {
+	nw, err := Get(nameOrId)
+	if err != nil {
+		log.Fatalf("Failed to find network %s: %v\n", nameOrId, err)
+	}
+	containers, err := state.List()
+	if err != nil {
+		log.Fatalf("Failed to list containers: %v\n", err)
+	}
+
+	endpoints := map[string]*state.Endpoint{}
+	for _, c := range containers {
+		if endpoint, found := c.Network.Networks[nw.Name]; found {
+			endpoints[c.Id] = endpoint
+		}
+	}
+	data, err := json.MarshalIndent(struct {
+		*Network
+		Containers map[string]*state.Endpoint
+	}{nw, endpoints}, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to marshal network %s: %v\n", nw.Name, err)
+	}
+	fmt.Println(string(data))
+}
@@ -1,105 +1,69 @@
 package ps
 
 import (
-	"bufio"
+	"encoding/json"
 	"fmt"
 	"go-docker/image"
+	"go-docker/network"
+	"go-docker/state"
 	"go-docker/utils"
 	"log"
 	"os"
-	"path/filepath"
-	"strconv"
 	"strings"
 )
 
 type ContainerInfo struct {
 	ContainerId string
+	Name        string
 	Image       string
 	Command     string
+	IPAddress   string
+	Ports       string
 	Pid         int
 }
 
-const basePath string = "/sys/fs/cgroup/cpu/go-docker"
+func getPortsDescription(ports []state.PortBinding) string {
+	var descriptions []string
+	for _, port := range ports {
+		descriptions = append(descriptions, port.String())
+	}
 
-func getDistribution(containerId string) (string, error) {
-	var lines []string
-	file, err := os.Open("/proc/mounts")
-	if err != nil {
-		fmt.Printf("Failed to read /proc/mounts: %v\n", err)
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanLines)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
-	}
-
-	for _, line := range lines {
-		if strings.Contains(line, containerId) {
-			layers := strings.Split(line, " ")
-			for _, layer := range layers {
-				options := strings.Split(layer, ",")
-				for _, option := range options {
-					if strings.Contains(option, "lowerdir=") {
-						imagesPath := utils.GetDockerImagePath()
-						leadString := "lowerdir=" + imagesPath + "/"
-						trailerString := option[len(leadString):]
-						imageId := trailerString[:12]
-						imageName, tag := image.ImageExistByHash(imageId)
-
-						return fmt.Sprintf("%s:%s", imageName, tag), nil
-					}
-				}
-			}
+	return strings.Join(descriptions, ", ")
+}
+
+// getIPAddressDescription lists addresses of all endpoints, the network container is started on goes first
+func getIPAddressDescription(settings *state.NetworkSettings) string {
+	var addresses []string
+	if endpoint := settings.PrimaryEndpoint(); endpoint != nil {
+		addresses = append(addresses, endpoint.IPAddress)
+	}
+	for name, endpoint := range settings.Networks {
+		if name != settings.Mode {
+			addresses = append(addresses, endpoint.IPAddress)
 		}
 	}
 
-	return "", nil
+	return strings.Join(addresses, ", ")
 }
 
 func GetContainerDetailsForId(containerId string) (ContainerInfo, error) {
 	container := ContainerInfo{}
-	var procs []string
-	procsPath := basePath + "/" + containerId + "/cgroup.procs"
 
-	file, err := os.Open(procsPath)
+	c, err := state.Load(containerId)
 	if err != nil {
-		fmt.Printf("Failed to read cgroup procs: %v\n", err)
+		fmt.Printf("Failed to read state of container %s: %v\n", containerId, err)
 		return container, err
 	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanLines)
-	for scanner.Scan() {
-		procs = append(procs, scanner.Text())
-	}
-
-	if len(procs) > 0 {
-		pid, err := strconv.Atoi(procs[len(procs)-1])
-		if err != nil {
-			fmt.Printf("Failed to read PID of container %s: %v\n", containerId, err)
-		}
-		cmd, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe")
-		if err != nil {
-			fmt.Println("Failed to read command link")
-			return container, err
-		}
 
-		containerMountPath := utils.GetDockerContainerPath() + "/" + containerId + "/fs/mnt"
-		realContainerMountPath, err := filepath.EvalSymlinks(containerMountPath)
-		if err != nil {
-			fmt.Println("Failed to resolve container mounting path")
-			return container, err
-		}
-
-		image, _ := getDistribution(containerId)
+	if c.IsRunning() {
 		container = ContainerInfo{
-			ContainerId: containerId,
-			Image:       image,
-			Command:     cmd[len(realContainerMountPath):],
-			Pid:         pid,
+			ContainerId: c.Id,
+			Name:        c.Name,
+			Image:       c.Image,
+			Command:     strings.Join(append([]string{c.Command}, c.Args...), " "),
+			IPAddress:   getIPAddressDescription(&c.Network),
+			Ports:       getPortsDescription(c.Network.Ports),
+			Pid:         c.Pid,
 		}
 	}
 
@@ -108,28 +72,20 @@ func GetContainerDetailsForId(containerId string) (ContainerInfo, error) {
 
 func GetRunningContainers() ([]ContainerInfo, error) {
 	var containers []ContainerInfo
-	basePath := utils.GetDockerContainerPath()
 
-	entries, err := os.ReadDir(basePath)
+	allContainers, err := state.List()
+	if err != nil {
+		return nil, err
+	}
 
-	if os.IsNotExist(err) {
-		return containers, nil
-	} else {
-		if err != nil {
-			return nil, err
-		} else {
-			for _, entry := range entries {
-				if entry.IsDir() {
-					container, _ := GetContainerDetailsForId(entry.Name())
-					if container.Pid > 0 {
-						containers = append(containers, container)
-					}
-				}
-			}
-
-			return containers, nil
+	for _, c := range allContainers {
+		container, _ := GetContainerDetailsForId(c.Id)
+		if container.Pid > 0 {
+			containers = append(containers, container)
 		}
 	}
+
+	return containers, nil
 }
 
 func PrintRunningContainers() {
@@ -138,26 +94,97 @@ func PrintRunningContainers() {
 		os.Exit(1)
 	}
 
-	fmt.Println("CONTAINER ID\tIMAGE\tCOMMAND")
+	fmt.Println("CONTAINER ID\tIMAGE\tCOMMAND\tIP ADDRESS\tPORTS\tNAMES")
 	for _, container := range containers {
-		fmt.Printf("%s\t%s\t%s\n", container.ContainerId, container.Image, container.Command)
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\n", container.ContainerId, container.Image, container.Command,
+			container.IPAddress, container.Ports, container.Name)
+	}
+}
+
+// containerDetails is container state with counters of its network interfaces at the moment
+type containerDetails struct {
+	*state.Container
+	NetworkInterfaces map[string]*network.EndpointStats
+}
+
+func InspectContainer(containerId string) {
+	interfaces, _, err := network.CollectContainerStats(containerId)
+	if err != nil {
+		log.Printf("Failed to collect network stats of container %s: %v\n", containerId, err)
+	}
+	c, err := state.Load(containerId)
+	if err != nil {
+		log.Fatalf("Failed to find container %s: %v\n", containerId, err)
+	}
+
+	data, err := json.MarshalIndent(&containerDetails{Container: c, NetworkInterfaces: interfaces}, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to marshal state of container %s: %v\n", containerId, err)
+	}
+	fmt.Println(string(data))
+}
+
+// formatBytes formats byte count in units of 1024 like 1.5MiB
+func formatBytes(bytes uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(bytes)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", bytes, units[0])
+	}
+
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
+
+// PrintContainerStats prints running total of network traffic of containers since they were created,
+// all running containers if no ID is given
+func PrintContainerStats(containerIds []string) {
+	if len(containerIds) == 0 {
+		containers, err := GetRunningContainers()
+		if err != nil {
+			log.Fatalf("Failed to get running containers: %v\n", err)
+		}
+		for _, container := range containers {
+			containerIds = append(containerIds, container.ContainerId)
+		}
+	}
+
+	fmt.Println("CONTAINER ID\tNAME\tNET RX\tNET TX\tRX PACKETS\tTX PACKETS\tRX ERRORS/DROPS\tTX ERRORS/DROPS")
+	for _, containerId := range containerIds {
+		_, total, err := network.CollectContainerStats(containerId)
+		if err != nil {
+			log.Printf("Failed to collect network stats of container %s: %v\n", containerId, err)
+			continue
+		}
+		name := ""
+		if c, err := state.Load(containerId); err == nil {
+			name = c.Name
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%d\t%d\t%d/%d\t%d/%d\n", containerId[:12], name,
+			formatBytes(total.RxBytes), formatBytes(total.TxBytes), total.RxPackets, total.TxPackets,
+			total.RxErrors, total.RxDropped, total.TxErrors, total.TxDropped)
 	}
 }
 
 func RemoveImageByHash(imgShaHex string) {
-	imageName, tag := image.ImageExistByHash(imgShaHex)
+	imageName, _ := image.ImageExistByHash(imgShaHex)
 	if imageName == "" {
 		log.Fatalf("Can't find image %s\n", imgShaHex)
 	}
 
-	containers, err := GetRunningContainers()
+	//Overlay of stopped containers still mounts image layers until they are cleaned
+	containers, err := state.List()
 	if err != nil {
-		log.Fatalf("Failed to get running container list: %v\n", err)
+		log.Fatalf("Failed to get container list: %v\n", err)
 	}
 
 	for _, container := range containers {
-		if container.Image == imageName+":"+tag {
-			log.Fatalf("Can't remove this image as it is used by container %s\n", container.ContainerId)
+		if container.ImageHash == imgShaHex {
+			log.Fatalf("Can't remove this image as it is used by container %s\n", container.Id)
 		}
 	}
 
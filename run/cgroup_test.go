@@ -0,0 +1,44 @@
+package run
+
+import (
+	"go-docker/cgroups"
+	"go-docker/state"
+	"testing"
+)
+
+func TestSetupContainerCGroupPassesResources(t *testing.T) {
+	var fake *cgroups.FakeManager
+	root := t.TempDir()
+	restore := newCGroupManager
+	newCGroupManager = func(containerId string) (cgroups.Manager, error) {
+		fake = cgroups.NewFakeManager(root, containerId, true)
+		return fake, nil
+	}
+	defer func() { newCGroupManager = restore }()
+
+	tests := []struct {
+		name string
+		res  cgroups.Resources
+	}{
+		{"unlimited", cgroups.NewResources()},
+		{"no swap", cgroups.Resources{MemoryMB: 64, SwapMB: 0, Pids: -1, Cpus: -1}},
+		{"fractional cpus", cgroups.Resources{MemoryMB: -1, SwapMB: -1, Pids: 32, Cpus: 0.25}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			container := &state.Container{Id: "0123456789ab", Resources: test.res}
+			if err := setupContainerCGroup(container, 42); err != nil {
+				t.Fatalf("setupContainerCGroup failed: %v", err)
+			}
+			if !fake.Created {
+				t.Errorf("Cgroup was not created")
+			}
+			if len(fake.Pids) != 1 || fake.Pids[0] != 42 {
+				t.Errorf("Applied pids %v, want [42]", fake.Pids)
+			}
+			if fake.Resources == nil || *fake.Resources != test.res {
+				t.Errorf("Set resources %+v, want %+v", fake.Resources, test.res)
+			}
+		})
+	}
+}
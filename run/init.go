@@ -0,0 +1,112 @@
+package run
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+
+	"golang.org/x/sys/unix"
+)
+
+// Signals which are not relayed to the container command: synchronous faults of init itself,
+// job control signals of terminal, SIGCHLD used for reaping and SIGURG used by go runtime
+var initIgnoredSignals = map[unix.Signal]bool{
+	unix.SIGFPE:  true,
+	unix.SIGILL:  true,
+	unix.SIGSEGV: true,
+	unix.SIGBUS:  true,
+	unix.SIGABRT: true,
+	unix.SIGTRAP: true,
+	unix.SIGSYS:  true,
+	unix.SIGTTIN: true,
+	unix.SIGTTOU: true,
+	unix.SIGCHLD: true,
+	unix.SIGURG:  true,
+}
+
+func isTerminal(fd int) bool {
+	_, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	return err == nil
+}
+
+// getExitCode converts wait status to exit code in the same way as shells, signal N gives 128+N
+func getExitCode(status unix.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+
+	return status.ExitStatus()
+}
+
+// getProcessExitCode maps signal death of a process to 128+N, instead of -1 given by ProcessState.ExitCode
+func getProcessExitCode(state *os.ProcessState) int {
+	if status, ok := state.Sys().(unix.WaitStatus); ok {
+		return getExitCode(status)
+	}
+
+	return state.ExitCode()
+}
+
+// getStartErrorExitCode follows shell convention: 127 if command is not found, 126 if it can't be executed
+func getStartErrorExitCode(err error) int {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		return 127
+	}
+
+	return 126
+}
+
+// runAsInit runs cmd as child of container PID 1 like tini: it relays signals to the child's process group,
+// reaps every zombie re-parented to PID 1, and returns exit code of the child once it exits
+func runAsInit(cmd *exec.Cmd) (int, error) {
+	sigChan := make(chan os.Signal, 64)
+	signal.Notify(sigChan)
+	defer signal.Stop(sigChan)
+
+	withTerminal := isTerminal(0)
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &unix.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.SysProcAttr.Foreground = withTerminal
+	cmd.SysProcAttr.Ctty = 0
+	if err := cmd.Start(); err != nil {
+		return -1, err
+	}
+	if withTerminal {
+		//Take terminal back from child, init is in background group so SIGTTOU must be ignored
+		defer func() {
+			signal.Ignore(unix.SIGTTOU)
+			unix.IoctlSetPointerInt(0, unix.TIOCSPGRP, unix.Getpgrp())
+		}()
+	}
+
+	childPid := cmd.Process.Pid
+	for sig := range sigChan {
+		unixSig, ok := sig.(unix.Signal)
+		if !ok {
+			continue
+		}
+		if unixSig != unix.SIGCHLD {
+			if !initIgnoredSignals[unixSig] {
+				unix.Kill(-childPid, unixSig)
+			}
+			continue
+		}
+
+		//One SIGCHLD may stand for several exited children
+		for {
+			var status unix.WaitStatus
+			pid, err := unix.Wait4(-1, &status, unix.WNOHANG, nil)
+			if err != nil || pid <= 0 {
+				break
+			}
+			if pid == childPid {
+				return getExitCode(status), nil
+			}
+		}
+	}
+
+	return -1, nil
+}
@@ -0,0 +1,161 @@
+package run
+
+import (
+	"fmt"
+	"go-docker/state"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Default seconds to wait for container to exit after stop signal, before killing it
+const DefaultStopTimeout = 10
+
+// ParseSignal accepts signal as number, or name with or without SIG prefix, like 9, KILL or SIGKILL
+func ParseSignal(sig string) (unix.Signal, error) {
+	if num, err := strconv.Atoi(sig); err == nil {
+		if num <= 0 || num > 64 {
+			return 0, fmt.Errorf("invalid signal number %d", num)
+		}
+		return unix.Signal(num), nil
+	}
+
+	name := strings.ToUpper(sig)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if num := unix.SignalNum(name); num != 0 {
+		return num, nil
+	}
+
+	return 0, fmt.Errorf("unknown signal %s", sig)
+}
+
+// forwardSignals relays signals received by current process to the container process, call returned func to stop
+func forwardSignals(process *os.Process, signals ...os.Signal) func() {
+	sigChan := make(chan os.Signal, 16)
+	done := make(chan struct{})
+	signal.Notify(sigChan, signals...)
+
+	go func() {
+		for {
+			select {
+			case sig := <-sigChan:
+				if err := process.Signal(sig); err != nil {
+					log.Printf("Failed to forward signal %v to container: %v\n", sig, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigChan)
+		close(done)
+	}
+}
+
+func loadRunningContainer(containerId string) *state.Container {
+	container, err := state.Load(containerId)
+	if err != nil {
+		log.Fatalf("Failed to find container %s: %v\n", containerId, err)
+	}
+	if !container.IsRunning() {
+		log.Fatalf("Container %s is not running\n", containerId)
+	}
+
+	return container
+}
+
+// isExitRecorded checks if the container exited and its shim, if any, finished recording the exit and
+// unpublishing its ports, so the container can be started again
+func isExitRecorded(container *state.Container) bool {
+	if container.IsRunning() {
+		return false
+	}
+	if container.Status != state.StatusRunning || container.ShimPid <= 0 {
+		return true
+	}
+
+	return unix.Kill(container.ShimPid, 0) != nil
+}
+
+// waitContainerExit polls container state until it stops running or timeout
+func waitContainerExit(containerId string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		container, err := state.Load(containerId)
+		if err != nil || isExitRecorded(container) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func KillContainer(containerId string, sig unix.Signal) {
+	container := loadRunningContainer(containerId)
+	if err := unix.Kill(container.Pid, sig); err != nil {
+		log.Fatalf("Failed to send signal %v to container %s: %v\n", sig, containerId, err)
+	}
+}
+
+// StopContainer asks the container to exit with stop signal of image (SIGTERM by default),
+// and kills it if still running after timeout seconds
+func StopContainer(containerId string, timeout int) {
+	container := loadRunningContainer(containerId)
+
+	stopSignal := unix.SIGTERM
+	if container.StopSignal != "" {
+		sig, err := ParseSignal(container.StopSignal)
+		if err != nil {
+			log.Printf("Invalid stop signal of container %s, use SIGTERM: %v\n", containerId, err)
+		} else {
+			stopSignal = sig
+		}
+	}
+	if err := unix.Kill(container.Pid, stopSignal); err != nil {
+		log.Fatalf("Failed to stop container %s: %v\n", containerId, err)
+	}
+	if waitContainerExit(containerId, time.Duration(timeout)*time.Second) {
+		return
+	}
+
+	log.Printf("Container %s didn't exit in %d seconds, killing it\n", containerId, timeout)
+	if err := unix.Kill(container.Pid, unix.SIGKILL); err != nil && err != unix.ESRCH {
+		log.Fatalf("Failed to kill container %s: %v\n", containerId, err)
+	}
+	if !waitContainerExit(containerId, time.Duration(DefaultStopTimeout)*time.Second) {
+		log.Fatalf("Container %s is still running after SIGKILL\n", containerId)
+	}
+}
+
+// RestartContainer stops the container if it is running, then starts it again in background
+func RestartContainer(containerId string, timeout int) {
+	container, err := state.Load(containerId)
+	if err != nil {
+		log.Fatalf("Failed to find container %s: %v\n", containerId, err)
+	}
+	if container.IsRunning() {
+		StopContainer(containerId, timeout)
+	}
+
+	if err := state.Update(containerId, func(c *state.Container) {
+		c.Status = state.StatusCreated
+		c.Detached = true
+		c.Pid = 0
+		c.ExitCode = 0
+	}); err != nil {
+		log.Fatalf("Failed to save state of container %s: %v\n", containerId, err)
+	}
+	startContainerShim(containerId)
+	fmt.Println(containerId)
+}
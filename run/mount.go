@@ -0,0 +1,206 @@
+package run
+
+import (
+	"fmt"
+	"go-docker/state"
+	"go-docker/volume"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// getContainerMounts parses -v and --mount options into mounts of the container
+func getContainerMounts(opts *Options) []state.Mount {
+	var mounts []state.Mount
+	for _, spec := range opts.Volumes {
+		mount, err := volume.ParseVolumeSpec(spec)
+		if err != nil {
+			log.Fatalf("Invalid volume option: %v\n", err)
+		}
+		mounts = append(mounts, mount)
+	}
+	for _, spec := range opts.Mounts {
+		mount, err := volume.ParseMountSpec(spec)
+		if err != nil {
+			log.Fatalf("Invalid mount option: %v\n", err)
+		}
+		mounts = append(mounts, mount)
+	}
+
+	return mounts
+}
+
+// Limit of symlinks followed while resolving a path in container root, like ELOOP of the kernel
+const maxSymlinks = 255
+
+// resolveContainerPath resolves path inside container root the way it is seen after chroot: symlinks of
+// the image are followed relative to root, and ".." never goes above it. Missing components are kept
+// as they are, so the result can be created. Path escaping root is refused
+func resolveContainerPath(root string, path string) (string, error) {
+	root = filepath.Clean(root)
+	queue := strings.Split(path, "/")
+	current := "/"
+	links := 0
+	for len(queue) > 0 {
+		part := queue[0]
+		queue = queue[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			current = filepath.Dir(current)
+			continue
+		}
+
+		next := filepath.Join(current, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if os.IsNotExist(err) || (err == nil && info.Mode()&os.ModeSymlink == 0) {
+			current = next
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", path)
+		}
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			current = "/"
+		}
+		queue = append(strings.Split(link, "/"), queue...)
+	}
+
+	resolved := filepath.Join(root, current)
+	if resolved != root && !strings.HasPrefix(resolved, root+"/") {
+		return "", fmt.Errorf("path %s escapes container root", path)
+	}
+
+	return resolved, nil
+}
+
+// sortMountsByDepth orders mounts so parent destinations are mounted before nested ones, which
+// would be hidden otherwise
+func sortMountsByDepth(mounts []state.Mount) []state.Mount {
+	sorted := append([]state.Mount{}, mounts...)
+	depth := func(destination string) int {
+		return strings.Count(filepath.Clean("/"+destination), "/")
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return depth(sorted[i].Destination) < depth(sorted[j].Destination)
+	})
+
+	return sorted
+}
+
+// createMountTarget creates mount point in container root, a file if the source is a file
+func createMountTarget(source string, target string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return os.MkdirAll(target, 0755)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(target); os.IsNotExist(err) {
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|unix.O_NOFOLLOW, 0644)
+		if err != nil {
+			return err
+		}
+		file.Close()
+	}
+
+	return nil
+}
+
+// mountContainerVolumes bind mounts host paths and volumes under container root, before chroot into it
+func mountContainerVolumes(container *state.Container, mountPath string) {
+	for _, mount := range sortMountsByDepth(container.Mounts) {
+		target, err := resolveContainerPath(mountPath, mount.Destination)
+		if err != nil {
+			log.Fatalf("Invalid mount point %s: %v\n", mount.Destination, err)
+		}
+		if err := createMountTarget(mount.Source, target); err != nil {
+			log.Fatalf("Failed to create mount point %s: %v\n", mount.Destination, err)
+		}
+		if err := unix.Mount(mount.Source, target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			log.Fatalf("Failed to mount %s to %s: %v\n", mount.Source, mount.Destination, err)
+		}
+		//Read only flag is ignored by the first bind mount, it must be applied by remount
+		if mount.ReadOnly {
+			if err := unix.Mount("", target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+				log.Fatalf("Failed to make mount %s read only: %v\n", mount.Destination, err)
+			}
+		}
+	}
+}
+
+// populateAnonymousVolumes copies what image has at paths of anonymous volumes into them, once when they
+// are created for the container. Container file system must be mounted at mountPath
+func populateAnonymousVolumes(container *state.Container, mountPath string) error {
+	for _, mount := range container.Mounts {
+		if mount.Type != state.MountTypeVolume || !mount.Anonymous {
+			continue
+		}
+		src, err := resolveContainerPath(mountPath, mount.Destination)
+		if err != nil {
+			return fmt.Errorf("invalid mount point %s: %w", mount.Destination, err)
+		}
+		if err := volume.Populate(mount.Source, src); err != nil {
+			return fmt.Errorf("failed to copy image content into volume %s: %w", mount.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// mountContainerEtcFiles generates hosts, hostname and resolv.conf of container in its directory,
+// and bind mounts them over the copies of image, so the image itself is never modified
+func mountContainerEtcFiles(container *state.Container, mountPath string) {
+	etcFiles := map[string]func(path string) error{
+		"hosts": func(path string) error {
+			return writeHostsFile(container, path)
+		},
+		"hostname": func(path string) error {
+			return os.WriteFile(path, []byte(container.Hostname+"\n"), 0644)
+		},
+		"resolv.conf": func(path string) error {
+			return writeResolvConf(container, path)
+		},
+	}
+
+	//Image controls /etc, which may itself be a symlink, so it is resolved inside container root
+	etcPath, err := resolveContainerPath(mountPath, "/etc")
+	if err != nil {
+		log.Fatalf("Invalid /etc of container: %v\n", err)
+	}
+	for name, writeFile := range etcFiles {
+		source := state.GetContainerHome(container.Id) + "/" + name
+		if err := writeFile(source); err != nil {
+			log.Fatalf("Failed to write %s of container: %v\n", name, err)
+		}
+		target := filepath.Join(etcPath, name)
+		//Image may have a symlink here, like resolv.conf pointing to systemd, replace it with a file
+		if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			os.Remove(target)
+		}
+		if err := createMountTarget(source, target); err != nil {
+			log.Fatalf("Failed to create mount point /etc/%s: %v\n", name, err)
+		}
+		if err := unix.Mount(source, target, "", unix.MS_BIND, ""); err != nil {
+			log.Fatalf("Failed to mount /etc/%s: %v\n", name, err)
+		}
+	}
+}
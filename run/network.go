@@ -0,0 +1,653 @@
+package run
+
+import (
+	"fmt"
+	"go-docker/dns"
+	"go-docker/network"
+	"go-docker/state"
+	"go-docker/utils"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// resolveNetworkMode validates --network option, it returns the network mode and the network to attach
+// the container to, which is nil for none, host and container:<id> modes
+func resolveNetworkMode(opts *Options) (string, *network.Network) {
+	mode := opts.Network
+	if mode == "" {
+		mode = network.DefaultNetworkName
+	}
+
+	if mode == state.NetworkModeNone || mode == state.NetworkModeHost || strings.HasPrefix(mode, state.NetworkModeContainerPrefix) {
+		if opts.IP != "" || opts.IPv6 != "" {
+			log.Fatalf("IP address can't be given with network mode %s\n", mode)
+		}
+		if len(opts.Ports) > 0 {
+			log.Fatalf("Ports can't be published with network mode %s\n", mode)
+		}
+		if len(opts.Aliases) > 0 {
+			log.Fatalf("Network aliases can't be given with network mode %s\n", mode)
+		}
+		if !opts.Shaping.IsEmpty() {
+			log.Fatalf("Network shaping can't be given with network mode %s\n", mode)
+		}
+		if len(opts.EgressAllow) > 0 {
+			log.Fatalf("Egress allow-list can't be given with network mode %s\n", mode)
+		}
+	}
+
+	switch {
+	case mode == state.NetworkModeNone || mode == state.NetworkModeHost:
+		return mode, nil
+	case strings.HasPrefix(mode, state.NetworkModeContainerPrefix):
+		target, err := state.Resolve(strings.TrimPrefix(mode, state.NetworkModeContainerPrefix))
+		if err != nil {
+			log.Fatalf("Failed to find container of network mode %s: %v\n", mode, err)
+		}
+		if !target.IsRunning() {
+			log.Fatalf("Container %s is not running, its network can't be joined\n", target.Id)
+		}
+		//Join the namespace owner directly, so a chain of shared namespaces never forms
+		owner := target.Network.GetNamespaceOwner(target.Id)
+		if owner == "" {
+			return state.NetworkModeHost, nil
+		}
+		return state.NetworkModeContainerPrefix + owner, nil
+	}
+
+	nw, err := network.Get(mode)
+	if err != nil {
+		log.Fatalf("Failed to find network %s: %v\n", mode, err)
+	}
+	driver, err := nw.GetDriver()
+	if err != nil {
+		log.Fatalf("Failed to get driver of network %s: %v\n", nw.Name, err)
+	}
+	if !driver.HostIsGateway() && len(opts.Ports) > 0 {
+		log.Fatalf("Ports can't be published on %s network %s, container is reachable at its own address\n", nw.Driver, nw.Name)
+	}
+	if !driver.HostIsGateway() && !opts.Shaping.IsEmpty() {
+		log.Fatalf("Network shaping can't be given on %s network %s\n", nw.Driver, nw.Name)
+	}
+	if !driver.HostIsGateway() && len(opts.EgressAllow) > 0 {
+		log.Fatalf("Egress allow-list can't be enforced on %s network %s, traffic doesn't pass host\n", nw.Driver, nw.Name)
+	}
+	return nw.Name, nw
+}
+
+// checkNetworkNamespaceUsers stops removing network namespace of a container while others run in it
+func checkNetworkNamespaceUsers(containerId string) {
+	containers, err := state.List()
+	if err != nil {
+		log.Fatalf("Failed to list containers: %v\n", err)
+	}
+	for _, c := range containers {
+		if c.Id != containerId && c.Network.GetNamespaceOwner(c.Id) == containerId && c.IsRunning() {
+			log.Fatalf("Network namespace of container %s is used by running container %s\n", containerId, c.Id)
+		}
+	}
+}
+
+// getEndpointIndex returns the first veth index which is not used by endpoints of the container
+func getEndpointIndex(container *state.Container) int {
+	used := map[string]bool{}
+	for _, endpoint := range container.Network.Networks {
+		used[endpoint.ContainerVeth] = true
+	}
+
+	index := 0
+	for {
+		//Container side is named by every driver, host side only by bridge
+		_, containerVeth := network.GetVethNames(container.Id, index)
+		if !used[containerVeth] {
+			return index
+		}
+		index++
+	}
+}
+
+// createEndpoint leases an address on the network and creates link of the container with the network driver
+func createEndpoint(container *state.Container, nw *network.Network, requestedIP string, requestedIPv6 string, aliases []string) (*state.Endpoint, error) {
+	driver, err := nw.GetDriver()
+	if err != nil {
+		return nil, err
+	}
+	if err := driver.Setup(nw); err != nil {
+		return nil, err
+	}
+	//Plugins of CNI network pick addresses when interface is added to network namespace of container
+	if nw.Driver == network.DriverCNI {
+		if requestedIP != "" || requestedIPv6 != "" {
+			return nil, fmt.Errorf("IP address of %s network %s is assigned by its plugins", nw.Driver, nw.Name)
+		}
+		_, containerVeth := network.GetVethNames(container.Id, getEndpointIndex(container))
+		endpoint := &state.Endpoint{NetworkId: nw.Id, ContainerVeth: containerVeth, Aliases: aliases}
+		return endpoint, driver.CreateEndpoint(nw, endpoint)
+	}
+	subnet, _, err := nw.GetSubnet()
+	if err != nil {
+		return nil, err
+	}
+	ipAddress, err := network.AllocateNetworkIP(nw, requestedIP, container.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	prefixLen, _ := subnet.Mask.Size()
+	hostVeth, containerVeth := network.GetVethNames(container.Id, getEndpointIndex(container))
+	endpoint := &state.Endpoint{
+		NetworkId:     nw.Id,
+		IPAddress:     ipAddress,
+		PrefixLen:     prefixLen,
+		Gateway:       nw.Gateway,
+		MacAddress:    network.CreateMACAddress().String(),
+		HostVeth:      hostVeth,
+		ContainerVeth: containerVeth,
+		Aliases:       aliases,
+	}
+	if nw.EnableIPv6 {
+		subnetV6, _, err := nw.GetSubnetV6()
+		if err != nil {
+			network.ReleaseIP(nw.Name, ipAddress, container.Id)
+			return nil, err
+		}
+		if endpoint.IPv6Address, err = network.AllocateNetworkIPv6(nw, requestedIPv6, container.Id); err != nil {
+			network.ReleaseIP(nw.Name, ipAddress, container.Id)
+			return nil, err
+		}
+		endpoint.PrefixLenV6, _ = subnetV6.Mask.Size()
+		endpoint.GatewayV6 = nw.GatewayV6
+	} else if requestedIPv6 != "" {
+		network.ReleaseIP(nw.Name, ipAddress, container.Id)
+		return nil, fmt.Errorf("network %s has no IPv6 enabled", nw.Name)
+	}
+
+	if err := driver.CreateEndpoint(nw, endpoint); err != nil {
+		releaseEndpoint(nw.Name, container.Id, endpoint)
+		return nil, fmt.Errorf("failed to create %s link on host: %w", nw.Driver, err)
+	}
+	//Only traffic passing host side veth can be shaped
+	if driver.HostIsGateway() {
+		if err := network.ApplyShaping(endpoint.HostVeth, &container.Network.Shaping); err != nil {
+			driver.DeleteEndpoint(container.Id, endpoint)
+			releaseEndpoint(nw.Name, container.Id, endpoint)
+			return nil, fmt.Errorf("failed to apply network shaping: %w", err)
+		}
+	}
+
+	return endpoint, nil
+}
+
+// setupEndpointInterface moves container side of the endpoint into network namespace of the container,
+// it runs in a child process as joining a namespace affects the whole thread
+func setupEndpointInterface(containerId string, endpoint *state.Endpoint, isPrimary bool) error {
+	address := endpoint.IPAddress + "/" + strconv.Itoa(endpoint.PrefixLen)
+	addressV6 := ""
+	if endpoint.IPv6Address != "" {
+		addressV6 = endpoint.IPv6Address + "/" + strconv.Itoa(endpoint.PrefixLenV6)
+	}
+	gateway, gatewayV6 := "", ""
+	if isPrimary {
+		gateway, gatewayV6 = endpoint.Gateway, endpoint.GatewayV6
+	}
+
+	cmd := &exec.Cmd{
+		Path:   "/proc/self/exe",
+		Args:   []string{"/proc/self/exe", "setup-veth", containerId, endpoint.ContainerVeth, address, gateway, addressV6, gatewayV6},
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	return cmd.Run()
+}
+
+// attachEndpoint makes the endpoint show up in network namespace of the container, addresses given by
+// CNI plugins are saved into container state
+func attachEndpoint(containerId string, networkName string, endpoint *state.Endpoint, isPrimary bool) error {
+	nw, err := network.Get(networkName)
+	if err != nil {
+		return err
+	}
+	if nw.Driver != network.DriverCNI {
+		return setupEndpointInterface(containerId, endpoint, isPrimary)
+	}
+
+	if err := network.AddCNIEndpoint(nw, containerId, endpoint); err != nil {
+		return err
+	}
+	return state.Update(containerId, func(c *state.Container) {
+		if _, found := c.Network.Networks[networkName]; found {
+			c.Network.Networks[networkName] = endpoint
+		}
+	})
+}
+
+// deleteContainerEndpoints deletes links of all endpoints of the container, while network namespace
+// of container still exists so links moved there and CNI plugins can be reached
+func deleteContainerEndpoints(container *state.Container) {
+	for name, endpoint := range container.Network.Networks {
+		nw, err := network.Get(name)
+		if err != nil {
+			//Network is gone, host side veth is still deleted by its name, other links go with the namespace
+			if endpoint.HostVeth != "" {
+				if err := network.DeleteVirtualEth(endpoint.HostVeth); err != nil {
+					log.Printf("Failed to delete interface of network %s: %v\n", name, err)
+				}
+			}
+			continue
+		}
+		driver, err := nw.GetDriver()
+		if err != nil {
+			log.Printf("Failed to get driver of network %s: %v\n", name, err)
+			continue
+		}
+		if err := driver.DeleteEndpoint(container.Id, endpoint); err != nil {
+			log.Printf("Failed to delete interface of network %s: %v\n", name, err)
+		}
+	}
+}
+
+func hasNetworkNamespace(containerId string) bool {
+	_, err := os.Stat(utils.GetDockerNetNsPath() + "/" + containerId)
+	return err == nil
+}
+
+// restoreEndpoint makes the network of the endpoint ready and creates links of the endpoint on host
+// again if they are gone, like after a reboot. Links created by run or network connect are kept as they are
+func restoreEndpoint(container *state.Container, networkName string, endpoint *state.Endpoint) error {
+	nw, err := network.Get(networkName)
+	if err != nil {
+		return err
+	}
+	driver, err := nw.GetDriver()
+	if err != nil {
+		return err
+	}
+	if err := driver.Setup(nw); err != nil {
+		return err
+	}
+	//Container side is on host until it is moved into the namespace, which doesn't exist yet
+	if network.LinkExists(endpoint.ContainerVeth) {
+		return nil
+	}
+	if err := driver.CreateEndpoint(nw, endpoint); err != nil {
+		return fmt.Errorf("failed to create %s link on host: %w", nw.Driver, err)
+	}
+	if driver.HostIsGateway() {
+		if err := network.ApplyShaping(endpoint.HostVeth, &container.Network.Shaping); err != nil {
+			driver.DeleteEndpoint(container.Id, endpoint)
+			return fmt.Errorf("failed to apply network shaping: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// setupContainerNetwork creates network namespace of the container and attaches all its endpoints,
+// bridges and links gone since the container was created are set up again. On error the namespace is
+// removed, so the next start sets it up from scratch
+func setupContainerNetwork(container *state.Container) error {
+	containerId := container.Id
+	for name, endpoint := range container.Network.Networks {
+		if err := restoreEndpoint(container, name, endpoint); err != nil {
+			return fmt.Errorf("failed to setup network %s: %w", name, err)
+		}
+	}
+
+	//Setup network namaspace
+	cmd := &exec.Cmd{
+		Path:   "/proc/self/exe",
+		Args:   []string{"/proc/self/exe", "setup-netns", containerId},
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	if err := cmd.Run(); err != nil {
+		network.RemoveNetworkNamespace(containerId)
+		return fmt.Errorf("failed to create network namespace: %w", err)
+	}
+
+	//Interfaces are created again with counters from zero, total is kept
+	container.Network.Stats.LastSeen = nil
+	if err := state.Update(containerId, func(c *state.Container) {
+		c.Network.Stats.LastSeen = nil
+	}); err != nil {
+		log.Printf("Failed to reset network stats of container %s: %v\n", containerId, err)
+	}
+
+	//Setup virtual ethernet inferfaces, only the network container is started on gets default route
+	attached := map[string]*state.Endpoint{}
+	for name, endpoint := range container.Network.Networks {
+		if err := attachEndpoint(containerId, name, endpoint, name == container.Network.Mode); err != nil {
+			//CNI plugins of attached endpoints hold addresses outside the namespace, so they are deleted
+			//too. Links go away with the namespace and all are created again on next start
+			deleteContainerEndpoints(&state.Container{Id: containerId, Network: state.NetworkSettings{Networks: attached}})
+			network.RemoveNetworkNamespace(containerId)
+			return fmt.Errorf("failed to setup interface of network %s: %w", name, err)
+		}
+		attached[name] = endpoint
+	}
+
+	return nil
+}
+
+func checkDNSServers(servers []string) {
+	for _, server := range servers {
+		if net.ParseIP(server) == nil {
+			log.Fatalf("Invalid DNS server %s, it must be an IP address\n", server)
+		}
+	}
+}
+
+// loadNetworkNamespaceOwner returns the container whose network namespace the container uses,
+// which is the container itself unless it shares namespace of another one, nil for host network
+func loadNetworkNamespaceOwner(container *state.Container) *state.Container {
+	ownerId := container.Network.GetNamespaceOwner(container.Id)
+	if ownerId == "" {
+		return nil
+	}
+	if ownerId == container.Id {
+		return container
+	}
+
+	owner, err := state.Load(ownerId)
+	if err != nil {
+		log.Printf("Failed to load state of container %s: %v\n", ownerId, err)
+		return nil
+	}
+	return owner
+}
+
+// getEmbeddedDNSServer returns address of DNS server of the network the container is started on,
+// empty if the network has none. Container sharing network namespace uses the server of the owner
+func getEmbeddedDNSServer(container *state.Container) string {
+	owner := loadNetworkNamespaceOwner(container)
+	if owner == nil || owner.Network.Mode == network.DefaultNetworkName || !owner.Network.UsesNetworks() {
+		return ""
+	}
+	//Gateway of macvlan and ipvlan networks is not host, which runs no DNS server there
+	nw, err := network.Get(owner.Network.Mode)
+	if err != nil {
+		return ""
+	}
+	if driver, err := nw.GetDriver(); err != nil || !driver.HostIsGateway() {
+		return ""
+	}
+	if endpoint := owner.Network.PrimaryEndpoint(); endpoint != nil {
+		return endpoint.Gateway
+	}
+
+	return ""
+}
+
+// writeResolvConf writes resolv.conf of container from resolver config of host and DNS options,
+// containers on user-defined networks query the embedded DNS server, which forwards to the servers
+func writeResolvConf(container *state.Container, path string) error {
+	conf, err := dns.GetHostResolvConf()
+	if err != nil {
+		return err
+	}
+	if len(container.DNS.Servers) > 0 {
+		conf.Nameservers = container.DNS.Servers
+	}
+	if server := getEmbeddedDNSServer(container); server != "" {
+		conf.Nameservers = []string{server}
+	}
+	if len(container.DNS.Search) > 0 {
+		conf.Search = container.DNS.Search
+	}
+	if len(container.DNS.Options) > 0 {
+		conf.Options = container.DNS.Options
+	}
+
+	return os.WriteFile(path, []byte(conf.String()), 0644)
+}
+
+// Entries every hosts file starts with
+const defaultHostsEntries = `127.0.0.1	localhost
+::1	localhost ip6-localhost ip6-loopback
+fe00::0	ip6-localnet
+ff00::0	ip6-mcastprefix
+ff02::1	ip6-allnodes
+ff02::2	ip6-allrouters
+`
+
+// ParseExtraHost parses --add-host option name:ip
+func ParseExtraHost(spec string) (string, string, error) {
+	name, ip, found := strings.Cut(spec, ":")
+	if !found || name == "" || net.ParseIP(ip) == nil {
+		return "", "", fmt.Errorf("invalid host %s, expect name:ip", spec)
+	}
+
+	return name, ip, nil
+}
+
+// writeHostsFile writes hosts file of container with extra hosts and addresses of the container
+// mapped to its hostname, container on host network gets hosts file of host instead
+func writeHostsFile(container *state.Container, path string) error {
+	var content strings.Builder
+	owner := loadNetworkNamespaceOwner(container)
+	if owner == nil {
+		hostData, err := os.ReadFile("/etc/hosts")
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		content.Write(hostData)
+	} else {
+		content.WriteString(defaultHostsEntries)
+	}
+
+	for _, spec := range container.ExtraHosts {
+		if name, ip, err := ParseExtraHost(spec); err == nil {
+			fmt.Fprintf(&content, "%s\t%s\n", ip, name)
+		}
+	}
+
+	if owner != nil {
+		names := container.Hostname
+		if container.Name != "" && container.Name != container.Hostname {
+			names += " " + container.Name
+		}
+		writeEndpoint := func(endpoint *state.Endpoint) {
+			fmt.Fprintf(&content, "%s\t%s\n", endpoint.IPAddress, names)
+			if endpoint.IPv6Address != "" {
+				fmt.Fprintf(&content, "%s\t%s\n", endpoint.IPv6Address, names)
+			}
+		}
+		if endpoint := owner.Network.PrimaryEndpoint(); endpoint != nil {
+			writeEndpoint(endpoint)
+		}
+		for name, endpoint := range owner.Network.Networks {
+			if name != owner.Network.Mode {
+				writeEndpoint(endpoint)
+			}
+		}
+	}
+
+	return os.WriteFile(path, []byte(content.String()), 0644)
+}
+
+// releaseEndpoint releases addresses leased by an endpoint, those of CNI networks are released by DEL of plugins
+func releaseEndpoint(networkName string, containerId string, endpoint *state.Endpoint) {
+	if nw, err := network.Get(networkName); err == nil && nw.Driver == network.DriverCNI {
+		return
+	}
+	for _, address := range []string{endpoint.IPAddress, endpoint.IPv6Address} {
+		if address == "" {
+			continue
+		}
+		if err := network.ReleaseIP(networkName, address, containerId); err != nil {
+			log.Printf("Failed to release IP address of container %s: %v\n", containerId, err)
+		}
+	}
+}
+
+// releaseContainerNetworks releases addresses leased by endpoints of the container
+func releaseContainerNetworks(container *state.Container) {
+	for name, endpoint := range container.Network.Networks {
+		releaseEndpoint(name, container.Id, endpoint)
+	}
+}
+
+// applyEgressRules replaces egress rules of the container with its allow-list, for addresses of all its endpoints
+func applyEgressRules(container *state.Container) error {
+	if len(container.Network.EgressAllow) == 0 {
+		return nil
+	}
+	var rules []*network.EgressRule
+	for _, spec := range container.Network.EgressAllow {
+		rule, err := network.ParseEgressRule(spec)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+	}
+
+	var endpoints []*network.EgressEndpoint
+	for name, endpoint := range container.Network.Networks {
+		egressEndpoint := &network.EgressEndpoint{
+			HostVeth:  endpoint.HostVeth,
+			Addresses: []string{endpoint.IPAddress, endpoint.IPv6Address},
+		}
+		//Embedded DNS server of user-defined bridge networks listens on the gateway
+		if nw, err := network.Get(name); err == nil && nw.Driver == network.DriverBridge && nw.Name != network.DefaultNetworkName {
+			egressEndpoint.DNSServer = endpoint.Gateway
+		}
+		endpoints = append(endpoints, egressEndpoint)
+	}
+
+	return network.SetupEgressRules(container.Id, endpoints, rules)
+}
+
+// ConnectContainer attaches a container to one more network, the new interface shows up in container
+// at once if its network namespace exists, or when it is started otherwise
+func ConnectContainer(containerId string, networkName string, requestedIP string, requestedIPv6 string, aliases []string) {
+	container, err := state.Load(containerId)
+	if err != nil {
+		log.Fatalf("Failed to load state of container %s: %v\n", containerId, err)
+	}
+	nw, err := network.Get(networkName)
+	if err != nil {
+		log.Fatalf("Failed to find network %s: %v\n", networkName, err)
+	}
+	if !container.Network.UsesNetworks() {
+		log.Fatalf("Container %s runs with network mode %s, it can't be connected to networks\n", containerId, container.Network.Mode)
+	}
+	if _, found := container.Network.Networks[nw.Name]; found {
+		log.Fatalf("Container %s is already connected to network %s\n", containerId, nw.Name)
+	}
+	if len(container.Network.EgressAllow) > 0 {
+		if driver, err := nw.GetDriver(); err != nil || !driver.HostIsGateway() {
+			log.Fatalf("Container %s has egress allow-list, which can't be enforced on %s network %s\n", containerId, nw.Driver, nw.Name)
+		}
+	}
+
+	endpoint, err := createEndpoint(container, nw, requestedIP, requestedIPv6, aliases)
+	if err != nil {
+		log.Fatalf("Failed to connect container %s to network %s: %v\n", containerId, nw.Name, err)
+	}
+	if err := state.Update(containerId, func(c *state.Container) {
+		if c.Network.Networks == nil {
+			c.Network.Networks = map[string]*state.Endpoint{}
+		}
+		c.Network.Networks[nw.Name] = endpoint
+	}); err != nil {
+		log.Fatalf("Failed to save state of container %s: %v\n", containerId, err)
+	}
+	//Rules cover the new address before the interface shows up in container
+	container.Network.Networks[nw.Name] = endpoint
+	if err := applyEgressRules(container); err != nil {
+		log.Fatalf("Failed to setup egress rules of container %s: %v\n", containerId, err)
+	}
+
+	if hasNetworkNamespace(containerId) {
+		if err := attachEndpoint(containerId, nw.Name, endpoint, false); err != nil {
+			//Connection is undone, so a failed connect leaves no endpoint without interface behind
+			deleteContainerEndpoints(&state.Container{Id: containerId, Network: state.NetworkSettings{
+				Networks: map[string]*state.Endpoint{nw.Name: endpoint},
+			}})
+			releaseEndpoint(nw.Name, containerId, endpoint)
+			if err := state.Update(containerId, func(c *state.Container) {
+				delete(c.Network.Networks, nw.Name)
+			}); err != nil {
+				log.Printf("Failed to save state of container %s: %v\n", containerId, err)
+			}
+			delete(container.Network.Networks, nw.Name)
+			if err := applyEgressRules(container); err != nil {
+				log.Printf("Failed to setup egress rules of container %s: %v\n", containerId, err)
+			}
+			log.Fatalf("Failed to setup interface of network %s: %v\n", nw.Name, err)
+		}
+	}
+}
+
+// DisconnectContainer detaches a container from a network and releases its address
+func DisconnectContainer(containerId string, networkName string) {
+	container, err := state.Load(containerId)
+	if err != nil {
+		log.Fatalf("Failed to load state of container %s: %v\n", containerId, err)
+	}
+	nw, err := network.Get(networkName)
+	if err != nil {
+		log.Fatalf("Failed to find network %s: %v\n", networkName, err)
+	}
+	endpoint, found := container.Network.Networks[nw.Name]
+	if !found {
+		log.Fatalf("Container %s is not connected to network %s\n", containerId, nw.Name)
+	}
+	if nw.Name == container.Network.Mode && len(container.Network.Ports) > 0 {
+		log.Fatalf("Container %s publishes ports on network %s, it can't be disconnected\n", containerId, nw.Name)
+	}
+
+	driver, err := nw.GetDriver()
+	if err != nil {
+		log.Fatalf("Failed to get driver of network %s: %v\n", nw.Name, err)
+	}
+	//Traffic of the interface stays in running total after it is deleted
+	if _, _, err := network.CollectContainerStats(containerId); err != nil {
+		log.Printf("Failed to collect network stats of container %s: %v\n", containerId, err)
+	}
+	if err := driver.DeleteEndpoint(containerId, endpoint); err != nil {
+		log.Fatalf("Failed to delete interface of network %s: %v\n", nw.Name, err)
+	}
+	releaseEndpoint(nw.Name, containerId, endpoint)
+	if err := state.Update(containerId, func(c *state.Container) {
+		delete(c.Network.Networks, nw.Name)
+		c.Network.Stats.Forget(endpoint.ContainerVeth)
+	}); err != nil {
+		log.Fatalf("Failed to save state of container %s: %v\n", containerId, err)
+	}
+	//Released address may be leased to another container, so it loses rules of this one
+	delete(container.Network.Networks, nw.Name)
+	if err := applyEgressRules(container); err != nil {
+		log.Fatalf("Failed to setup egress rules of container %s: %v\n", containerId, err)
+	}
+}
+
+// UpdateNetworkShaping replaces network shaping of a container, it takes effect at once on all its endpoints
+func UpdateNetworkShaping(containerId string, shaping state.Shaping) {
+	container, err := state.Load(containerId)
+	if err != nil {
+		log.Fatalf("Failed to load state of container %s: %v\n", containerId, err)
+	}
+	if !container.Network.UsesNetworks() {
+		log.Fatalf("Container %s runs with network mode %s, its network can't be shaped\n", containerId, container.Network.Mode)
+	}
+
+	if err := state.Update(containerId, func(c *state.Container) {
+		c.Network.Shaping = shaping
+	}); err != nil {
+		log.Fatalf("Failed to save state of container %s: %v\n", containerId, err)
+	}
+	for name, endpoint := range container.Network.Networks {
+		//Endpoints of macvlan and ipvlan networks have no host side to shape
+		if endpoint.HostVeth == "" {
+			continue
+		}
+		if err := network.ApplyShaping(endpoint.HostVeth, &shaping); err != nil {
+			log.Printf("Failed to shape interface of network %s: %v\n", name, err)
+		}
+	}
+}
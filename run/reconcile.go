@@ -0,0 +1,131 @@
+package run
+
+import (
+	"fmt"
+	"go-docker/network"
+	"go-docker/state"
+	"go-docker/utils"
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Container directory without state is taken as a crashed run only after this time, before that
+// the container may still be being created
+const reconcileGracePeriod = 10 * time.Minute
+
+// getContainerIds returns IDs of containers whose resources must be kept, and IDs of directories
+// left by runs which crashed before the container state was saved
+func getContainerIds() (map[string]bool, []string, error) {
+	containerIds := map[string]bool{}
+	entries, err := os.ReadDir(utils.GetDockerContainerPath())
+	if os.IsNotExist(err) {
+		return containerIds, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	var abandoned []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := state.Load(entry.Name()); err == nil {
+			containerIds[entry.Name()] = true
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < reconcileGracePeriod {
+			containerIds[entry.Name()] = true
+			continue
+		}
+		abandoned = append(abandoned, entry.Name())
+	}
+
+	return containerIds, abandoned, nil
+}
+
+func printReconciled(kind string, names []string, dryRun bool) {
+	action := "Removed"
+	if dryRun {
+		action = "Would remove"
+	}
+	for _, name := range names {
+		fmt.Printf("%s %s %s\n", action, kind, name)
+	}
+}
+
+func reconcileNetwork(containerIds map[string]bool, dryRun bool) {
+	prunes := []struct {
+		kind  string
+		prune func(map[string]bool, bool) ([]string, error)
+	}{
+		{"link", network.PruneLinks},
+		{"network namespace", network.PruneNetworkNamespaces},
+		{"lease", network.PruneLeases},
+		{"firewall rules", network.PruneFirewallRules},
+		{"CNI result", network.PruneCNIResults},
+	}
+	//Keep going on errors, one broken resource shouldn't leave the others behind
+	for _, p := range prunes {
+		removed, err := p.prune(containerIds, dryRun)
+		printReconciled(p.kind, removed, dryRun)
+		if err != nil {
+			log.Printf("Failed to prune %s: %v\n", p.kind, err)
+		}
+	}
+}
+
+// PruneNetwork removes network resources left by containers which are gone: veth pairs and other links
+// on host, network namespace mounts, address leases, firewall rules and cached CNI results
+func PruneNetwork(dryRun bool) {
+	containerIds, _, err := getContainerIds()
+	if err != nil {
+		log.Fatalf("Failed to list containers: %v\n", err)
+	}
+	reconcileNetwork(containerIds, dryRun)
+}
+
+// removeAbandonedContainer removes what a run which crashed before saving container state may have
+// created, the file system mount and cgroups. Network resources are pruned afterwards
+func removeAbandonedContainer(containerId string) error {
+	mountFSPath := getContainerFSHome(containerId) + "/mnt"
+	if err := unix.Unmount(mountFSPath, unix.MNT_DETACH); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		//Removing files under a mounted overlay would write into the image layers
+		return fmt.Errorf("failed to unmount %s: %w", mountFSPath, err)
+	}
+	if cgroupManager, err := newCGroupManager(containerId); err == nil {
+		if err := cgroupManager.Destroy(); err != nil {
+			log.Printf("Failed to remove cgroups of container %s: %v\n", containerId, err)
+		}
+	}
+
+	return os.RemoveAll(utils.GetDockerContainerPath() + "/" + containerId)
+}
+
+// ReconcileSystem brings host back in line with container state after crashed runs: directories of
+// containers which were never saved are removed, then network resources of missing containers are pruned
+func ReconcileSystem(dryRun bool) {
+	containerIds, abandoned, err := getContainerIds()
+	if err != nil {
+		log.Fatalf("Failed to list containers: %v\n", err)
+	}
+
+	var removed []string
+	for _, containerId := range abandoned {
+		if !dryRun {
+			if err := removeAbandonedContainer(containerId); err != nil {
+				log.Printf("Failed to remove abandoned container %s: %v\n", containerId, err)
+				//Its resources are kept while the directory is there
+				containerIds[containerId] = true
+				continue
+			}
+		}
+		removed = append(removed, containerId)
+	}
+	printReconciled("abandoned container", removed, dryRun)
+
+	reconcileNetwork(containerIds, dryRun)
+}
@@ -5,14 +5,20 @@ import (
 	"fmt"
 	"go-docker/cgroups"
 	"go-docker/image"
+	"go-docker/logs"
 	"go-docker/network"
-	"go-docker/ps"
+	"go-docker/state"
 	"go-docker/utils"
+	"go-docker/volume"
+	"io"
 	"log"
 	"os"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -75,51 +81,45 @@ func mountOveryFileSystem(containerId string, imgShaHex string) {
 	}
 }
 
-func prepareAndExecuteContainer(
-	mem int,
-	swap int,
-	pids int,
-	cpus float64,
-	containerId string,
-	cmdArgs []string,
-) {
-	//Setup network namaspace
-	cmd := &exec.Cmd{
-		Path:   "/proc/self/exe",
-		Args:   []string{"/proc/self/exe", "setup-netns", containerId},
-		Stdout: os.Stdout,
-		Stdin:  os.Stdin,
-	}
-	cmd.Run()
-
-	//Setup virtual ethernet inferface
-	cmd = &exec.Cmd{
-		Path:   "/proc/self/exe",
-		Args:   []string{"/proc/self/exe", "setup-veth", containerId},
-		Stdout: os.Stdout,
-		Stdin:  os.Stdin,
-	}
-	cmd.Run()
-
-	//Setup resource limitation
-	var options []string
-	if mem > 0 {
-		options = append(options, "--mem="+strconv.Itoa(mem))
-	}
-	if swap > 0 {
-		options = append(options, "--swap="+strconv.Itoa(swap))
-	}
-	if pids > 0 {
-		options = append(options, "--pids="+strconv.Itoa(pids))
+// Factory of cgroup manager, can be replaced to run containers without real cgroupfs
+var newCGroupManager = cgroups.NewManager
+
+// startContainerProcess starts inner-mode process of the container in new namespaces and marks it running
+func startContainerProcess(container *state.Container, stdin io.Reader, stdout io.Writer, stderr io.Writer) (*exec.Cmd, error) {
+	containerId := container.Id
+	//Network namespace outlives container process, so restarted container keeps its network
+	if owner := container.Network.GetNamespaceOwner(containerId); owner == containerId {
+		if !hasNetworkNamespace(containerId) {
+			if err := setupContainerNetwork(container); err != nil {
+				recordContainerExit(containerId, -1)
+				return nil, err
+			}
+		}
+		//Rules are gone with nftables tables after reboot or flush, container never starts without them
+		if err := applyEgressRules(container); err != nil {
+			recordContainerExit(containerId, -1)
+			return nil, fmt.Errorf("failed to setup egress rules: %w", err)
+		}
+	} else if owner != "" && !hasNetworkNamespace(owner) {
+		recordContainerExit(containerId, -1)
+		return nil, fmt.Errorf("network namespace of container %s doesn't exist", owner)
 	}
-	if cpus > 0 {
-		options = append(options, "--cpus="+strconv.FormatFloat(cpus, 'f', 1, 64))
+
+	//Proxies and DNAT rules of published ports only exist while the container runs
+	if err := publishContainerPorts(container); err != nil {
+		recordContainerExit(containerId, -1)
+		return nil, fmt.Errorf("failed to publish ports: %w", err)
 	}
 
-	args := append([]string{containerId}, cmdArgs...)
+	//Resource limits are read from container state by inner-mode process
+	var options []string
+	if !container.Init {
+		options = append(options, "--init=false")
+	}
+	args := append([]string{containerId, container.Command}, container.Args...)
 	args = append(options, args...)
 	args = append([]string{"inner-mode"}, args...)
-	cmd = exec.Command("/proc/self/exe", args...)
+	cmd := exec.Command("/proc/self/exe", args...)
 	cmd.SysProcAttr = &unix.SysProcAttr{
 		/*
 			From namespaces(7)
@@ -140,111 +140,601 @@ func prepareAndExecuteContainer(
 		*/
 		Cloneflags: unix.CLONE_NEWIPC | unix.CLONE_NEWNS | unix.CLONE_NEWPID | unix.CLONE_NEWUTS,
 	}
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("Failed to create container %s: %v\n", containerId, err)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		recordContainerExit(containerId, -1)
+		return nil, err
+	}
+	if err := state.Update(containerId, func(c *state.Container) {
+		c.Pid = cmd.Process.Pid
+		c.Status = state.StatusRunning
+		c.Started = time.Now()
+	}); err != nil {
+		log.Printf("Failed to save state of container %s: %v\n", containerId, err)
 	}
 
+	return cmd, nil
 }
 
-func InitContainer(mem int, swap int, pids int, cpus float64, src string, options []string) {
-	containerId := createContainerId()
-	log.Printf("New container ID: %s\n", containerId)
+// waitContainerProcess waits inner-mode process of the container to exit and records its exit code,
+// error is only returned when the process can't be waited, not for non-zero exit
+func waitContainerProcess(containerId string, cmd *exec.Cmd) (int, error) {
+	err := cmd.Wait()
+	if _, isExitErr := err.(*exec.ExitError); err != nil && !isExitErr {
+		recordContainerExit(containerId, -1)
+		return -1, err
+	}
+
+	exitCode := getProcessExitCode(cmd.ProcessState)
+	recordContainerExit(containerId, exitCode)
+
+	return exitCode, nil
+}
+
+// recordContainerExit marks the container exited, and stops serving its published ports until next start
+func recordContainerExit(containerId string, exitCode int) {
+	//Take counters into running total now, in case interfaces are gone before next collection
+	if _, _, err := network.CollectContainerStats(containerId); err != nil {
+		log.Printf("Failed to collect network stats of container %s: %v\n", containerId, err)
+	}
+	var ports []state.PortBinding
+	if err := state.Update(containerId, func(c *state.Container) {
+		c.Status = state.StatusExited
+		c.ExitCode = exitCode
+		c.Finished = time.Now()
+		ports = append(ports, c.Network.Ports...)
+		for i := range c.Network.Ports {
+			c.Network.Ports[i].ProxyPid = 0
+		}
+	}); err != nil {
+		log.Printf("Failed to save state of container %s: %v\n", containerId, err)
+	}
+	if len(ports) > 0 {
+		network.UnpublishPorts(containerId, ports)
+	}
+}
+
+// Options are settings given to run command for a new container
+type Options struct {
+	Resources   cgroups.Resources
+	Detach      bool
+	Init        bool
+	LogMaxSize  int64
+	LogMaxFile  int
+	Name        string
+	Env         []string
+	EnvFiles    []string
+	WorkingDir  string
+	User        string
+	Hostname    string
+	Volumes     []string
+	Mounts      []string
+	Ports       []string
+	IP          string
+	IPv6        string
+	Network     string
+	Aliases     []string
+	DNS         state.DNSConfig
+	ExtraHosts  []string
+	Shaping     state.Shaping
+	EgressAllow []string
+}
+
+// openContainerLog opens log file of the container and returns writers capturing stdout and stderr
+func openContainerLog(container *state.Container) (*logs.Writer, io.WriteCloser, io.WriteCloser) {
+	logWriter, err := logs.NewWriter(container.Log.Path, container.Log.MaxSize, container.Log.MaxFile)
+	if err != nil {
+		log.Fatalf("Failed to open log file of container %s: %v\n", container.Id, err)
+	}
+
+	return logWriter, logWriter.Stream(logs.StreamStdout), logWriter.Stream(logs.StreamStderr)
+}
+
+// getForegroundOutput returns writer of a container stream in foreground run: the terminal itself, or
+// the output teed into container log if it is not a terminal
+func getForegroundOutput(output *os.File, logStream io.Writer) io.Writer {
+	if isTerminal(int(output.Fd())) {
+		return output
+	}
+
+	return io.MultiWriter(output, logStream)
+}
+
+func closeContainerLog(logWriter *logs.Writer, streams ...io.WriteCloser) {
+	for _, stream := range streams {
+		if err := stream.Close(); err != nil {
+			log.Printf("Failed to flush container log: %v\n", err)
+		}
+	}
+	logWriter.Close()
+}
+
+// parsePortSpecs parses -p options, so they are checked before anything is allocated for the container
+func parsePortSpecs(portSpecs []string) []state.PortBinding {
+	var ports []state.PortBinding
+	for _, spec := range portSpecs {
+		binding, err := network.ParsePortSpec(spec)
+		if err != nil {
+			log.Fatalf("Invalid port option: %v\n", err)
+		}
+		ports = append(ports, binding)
+	}
+
+	return ports
+}
+
+// publishContainerPorts publishes ports recorded in container state when it starts, rules and proxies
+// left by the previous run of the container are removed first
+func publishContainerPorts(container *state.Container) error {
+	if len(container.Network.Ports) == 0 {
+		return nil
+	}
+
+	endpoint := container.Network.PrimaryEndpoint()
+	if endpoint == nil {
+		return fmt.Errorf("ports can't be published with network mode %s", container.Network.Mode)
+	}
+	nw, err := network.Get(container.Network.Mode)
+	if err != nil {
+		return err
+	}
+	network.UnpublishPorts(container.Id, container.Network.Ports)
+	ports, err := network.PublishPorts(container.Id, nw.Bridge, endpoint.IPAddress, endpoint.IPv6Address, container.Network.Ports)
+	if err != nil {
+		return err
+	}
+	container.Network.Ports = ports
+
+	return state.Update(container.Id, func(c *state.Container) {
+		c.Network.Ports = ports
+	})
+}
+
+// abortContainerInit exits with error after undoing what InitContainer set up for the container, so a
+// failed run leaves no interfaces, leases, rules or directories behind
+func abortContainerInit(container *state.Container, format string, v ...interface{}) {
+	log.Printf(format, v...)
+	deleteContainerEndpoints(container)
+	network.UnpublishPorts(container.Id, container.Network.Ports)
+	if err := network.DeleteEgressRules(container.Id); err != nil {
+		log.Printf("Failed to delete egress rules of container %s: %v\n", container.Id, err)
+	}
+	releaseContainerNetworks(container)
+	if err := unix.Unmount(getContainerFSHome(container.Id)+"/mnt", 0); err != nil && err != unix.EINVAL {
+		log.Printf("Failed to unmount container file system: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.RemoveAll(utils.GetDockerContainerPath() + "/" + container.Id); err != nil {
+		log.Printf("Failed to remove container directory: %v\n", err)
+	}
+	volume.RemoveAnonymousVolumes(container)
+	os.Exit(1)
+}
+
+func InitContainer(opts *Options, src string, cmdArgs []string) {
+	checkContainerName(opts.Name)
+	checkDNSServers(opts.DNS.Servers)
+	for _, spec := range opts.ExtraHosts {
+		if _, _, err := ParseExtraHost(spec); err != nil {
+			log.Fatalf("Invalid add-host option: %v\n", err)
+		}
+	}
+	for _, spec := range opts.EgressAllow {
+		if _, err := network.ParseEgressRule(spec); err != nil {
+			log.Fatalf("Invalid egress-allow option: %v\n", err)
+		}
+	}
+	ports := parsePortSpecs(opts.Ports)
+	mounts := getContainerMounts(opts)
 	imageShaHex := image.DownloadImageIfRequired(src)
 
+	imgConfig := image.ParseContainerConfig(imageShaHex).Config
+	cmdArgs = getContainerCommand(&imgConfig, cmdArgs)
+	if len(cmdArgs) == 0 {
+		log.Fatalf("No command specified for container and image %s has no default command\n", src)
+	}
+	env := getContainerEnv(&imgConfig, opts)
+	workingDir := imgConfig.WorkingDir
+	if opts.WorkingDir != "" {
+		workingDir = opts.WorkingDir
+	}
+	user := imgConfig.User
+	if opts.User != "" {
+		user = opts.User
+	}
+	networkMode, nw := resolveNetworkMode(opts)
+
+	//Every option is checked by now, nothing is created on disk before this point
+	mounts = volume.PrepareMounts(mounts, imgConfig.Volumes)
+	containerId := createContainerId()
+	log.Printf("New container ID: %s\n", containerId)
 	log.Printf("Image to overlay mount: %s\n", imageShaHex)
 	createContainerDirs(containerId)
+
+	hostname := containerId
+	if networkMode == state.NetworkModeHost {
+		hostname, _ = os.Hostname()
+	}
+	if opts.Hostname != "" {
+		hostname = opts.Hostname
+	}
+
+	container := &state.Container{
+		Id:         containerId,
+		Name:       opts.Name,
+		Hostname:   hostname,
+		Image:      src,
+		ImageHash:  imageShaHex,
+		Command:    cmdArgs[0],
+		Args:       cmdArgs[1:],
+		Env:        env,
+		WorkingDir: workingDir,
+		User:       user,
+		StopSignal: imgConfig.StopSignal,
+		Resources:  opts.Resources,
+		Mounts:     mounts,
+		Network: state.NetworkSettings{
+			Mode:        networkMode,
+			Networks:    map[string]*state.Endpoint{},
+			Ports:       ports,
+			Shaping:     opts.Shaping,
+			EgressAllow: opts.EgressAllow,
+		},
+		DNS:        opts.DNS,
+		ExtraHosts: opts.ExtraHosts,
+		Log: state.LogConfig{
+			Path:    logs.GetLogPath(containerId),
+			MaxSize: opts.LogMaxSize,
+			MaxFile: opts.LogMaxFile,
+		},
+		Init:     opts.Init,
+		Detached: opts.Detach,
+		Status:   state.StatusCreated,
+		Created:  time.Now(),
+	}
+	//File system is mounted before addresses are leased, errors from here on go through abortContainerInit
 	mountOveryFileSystem(containerId, imageShaHex)
+	if err := populateAnonymousVolumes(container, getContainerFSHome(containerId)+"/mnt"); err != nil {
+		abortContainerInit(container, "Failed to prepare volumes of container %s: %v\n", containerId, err)
+	}
+	if nw != nil {
+		endpoint, err := createEndpoint(container, nw, opts.IP, opts.IPv6, opts.Aliases)
+		if err != nil {
+			abortContainerInit(container, "Failed to connect container to network %s: %v\n", nw.Name, err)
+		}
+		container.Network.Networks[nw.Name] = endpoint
+	}
+	if err := state.Save(container); err != nil {
+		abortContainerInit(container, "Failed to save state of container %s: %v\n", containerId, err)
+	}
+	if err := applyEgressRules(container); err != nil {
+		abortContainerInit(container, "Failed to setup egress rules of container %s: %v\n", containerId, err)
+	}
 
-	if err := network.SetupVirtualEthOnHost(containerId); err != nil {
-		log.Fatalf("Failed to setup Veth0 on host: %v", err)
+	if opts.Detach {
+		startContainerShim(containerId)
+		fmt.Println(containerId)
+		return
 	}
 
-	prepareAndExecuteContainer(mem, swap, pids, cpus, containerId, options)
-	log.Println("Container setup is finished!")
-}
+	//Output is captured into container log, except streams on a terminal which are passed as they are,
+	//so interactive programs keep their TTY
+	logWriter, stdoutLog, stderrLog := openContainerLog(container)
+	stdout, stderr := getForegroundOutput(os.Stdout, stdoutLog), getForegroundOutput(os.Stderr, stderrLog)
+	cmd, err := startContainerProcess(container, os.Stdin, stdout, stderr)
+	if err != nil {
+		log.Fatalf("Failed to create container %s: %v\n", containerId, err)
+	}
 
-func unmountNetworkNamespace(containerId string) {
-	netNsPath := utils.GetDockerNetNsPath() + "/" + containerId
-	if err := unix.Unmount(netNsPath, 0); err != nil {
-		log.Fatalf("Failed to unmount network namespace %s: %v\n", netNsPath, err)
+	stopForwarding := forwardSignals(cmd.Process, unix.SIGINT, unix.SIGTERM, unix.SIGWINCH)
+	exitCode, err := waitContainerProcess(containerId, cmd)
+	stopForwarding()
+	closeContainerLog(logWriter, stdoutLog, stderrLog)
+	if err != nil {
+		log.Fatalf("Failed to wait container %s: %v\n", containerId, err)
 	}
+	log.Println("Container setup is finished!")
+
+	//Exit with the status of container command, so callers can tell if it succeeded
+	os.Exit(exitCode)
 }
 
-func unmountContainerFileSystem(containerId string) {
+// unmountContainerFileSystem unmounts overlay of the container, file system which isn't mounted, like
+// after a reboot, is fine
+func unmountContainerFileSystem(containerId string) error {
 	mountFSPath := utils.GetDockerContainerPath() + "/" + containerId + "/fs/mnt"
-	if err := unix.Unmount(mountFSPath, 0); err != nil {
-		log.Fatalf("Failed to unmount container file system %s: %v\n", mountFSPath, err)
+	if err := unix.Unmount(mountFSPath, 0); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return fmt.Errorf("failed to unmount container file system %s: %w", mountFSPath, err)
 	}
+
+	return nil
 }
 
-func removeContainerDirs(containerId string) {
+func removeContainerDirs(containerId string) error {
 	containerDir := utils.GetDockerContainerPath() + "/" + containerId
 	if err := os.RemoveAll(containerDir); err != nil {
-		log.Fatalf("Failed to remove container directory: %v", err)
+		return fmt.Errorf("failed to remove container directory: %w", err)
 	}
+
+	return nil
 }
 
+// CleanUpContainer removes a container which is not running, with its network, file system, cgroups and
+// anonymous volumes. A failed step doesn't stop the others, failures are reported together at the end
 func CleanUpContainer(containerId string) {
 	containerPath := utils.GetDockerContainerPath() + "/" + containerId
 	if _, err := os.Stat(containerPath); os.IsNotExist(err) {
 		log.Fatalf("Invalid container id %s", containerId)
 	}
+	container, err := state.Load(containerId)
+	if err != nil {
+		log.Fatalf("Failed to load state of container %s: %v\n", containerId, err)
+	}
+	if container.IsRunning() {
+		log.Fatalf("Container %s is running, stop it before cleaning it up\n", containerId)
+	}
+	ownsNetworkNamespace := container.Network.GetNamespaceOwner(containerId) == containerId
+	if ownsNetworkNamespace {
+		checkNetworkNamespaceUsers(containerId)
+	}
 
-	unmountNetworkNamespace(containerId)
-	unmountContainerFileSystem(containerId)
-	cgroups.RemoveCGroups(containerId)
-	removeContainerDirs(containerId)
+	var errs []error
+	if ownsNetworkNamespace {
+		deleteContainerEndpoints(container)
+		if err := network.RemoveNetworkNamespace(containerId); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	network.UnpublishPorts(containerId, container.Network.Ports)
+	if err := network.DeleteEgressRules(containerId); err != nil {
+		errs = append(errs, fmt.Errorf("failed to delete egress rules: %w", err))
+	}
+	releaseContainerNetworks(container)
+
+	fsErr := unmountContainerFileSystem(containerId)
+	if fsErr != nil {
+		errs = append(errs, fsErr)
+	}
+	if cgroupManager, err := newCGroupManager(containerId); err != nil {
+		errs = append(errs, fmt.Errorf("failed to get cgroup manager: %w", err))
+	} else if err := cgroupManager.Destroy(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to remove cgroups: %w", err))
+	}
+	//Removing files under a mounted overlay would go through to its layers. Directory with the state is
+	//kept then, so clean can be run again once the file system is unmounted
+	if fsErr == nil {
+		if err := removeContainerDirs(containerId); err != nil {
+			errs = append(errs, err)
+		}
+		volume.RemoveAnonymousVolumes(container)
+	}
+
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("Failed to clean up container %s: %v\n", containerId, err)
+		}
+		os.Exit(1)
+	}
 }
 
-func copyNameserverConfig(containerId string) error {
-	resolveFilePaths := []string{
-		"/var/run/systemd/resolve/resolv.conf",
-		"/etc/gockerresolv.conf",
-		"/etc/resolv.conf",
+// Default PATH in container if image doesn't define it
+const defaultPathEnv = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// getContainerCommand composes command the Docker way: entrypoint of image followed by
+// arguments from command line, or followed by Cmd of image if no arguments are given
+func getContainerCommand(imgConfig *image.ImageConfig, cmdArgs []string) []string {
+	args := cmdArgs
+	if len(args) == 0 {
+		args = imgConfig.Cmd
 	}
 
-	for _, resolveFilePath := range resolveFilePaths {
-		if _, err := os.Stat(resolveFilePath); os.IsNotExist(err) {
+	return append(append([]string{}, imgConfig.Entrypoint...), args...)
+}
+
+func hasEnv(env []string, key string) bool {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeEnv turns KEY without value into KEY=VAL with value from host, like Docker
+func normalizeEnv(kv string) (string, bool) {
+	if strings.Contains(kv, "=") {
+		return kv, true
+	}
+	if value, found := os.LookupEnv(kv); found {
+		return kv + "=" + value, true
+	}
+
+	return "", false
+}
+
+// mergeEnv overrides variables in env with the ones in overrides which have the same key
+func mergeEnv(env []string, overrides []string) []string {
+	merged := append([]string{}, env...)
+	for _, kv := range overrides {
+		key, _, _ := strings.Cut(kv, "=")
+		replaced := false
+		for i, existing := range merged {
+			if strings.HasPrefix(existing, key+"=") {
+				merged[i] = kv
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, kv)
+		}
+	}
+
+	return merged
+}
+
+func parseEnvFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var env []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
 			continue
-		} else {
-			return utils.CopyFile(resolveFilePath, getContainerFSHome(containerId)+"/mnt/etc/resolv.conf")
+		}
+		if kv, ok := normalizeEnv(line); ok {
+			env = append(env, kv)
 		}
 	}
 
-	return nil
+	return env, nil
+}
+
+// getContainerEnv gives environment of image overridden by env files and then by -e options
+func getContainerEnv(imgConfig *image.ImageConfig, opts *Options) []string {
+	env := append([]string{}, imgConfig.Env...)
+	if !hasEnv(env, "PATH") {
+		env = append(env, defaultPathEnv)
+	}
+
+	for _, envFile := range opts.EnvFiles {
+		fileEnv, err := parseEnvFile(envFile)
+		if err != nil {
+			log.Fatalf("Failed to read env file %s: %v\n", envFile, err)
+		}
+		env = mergeEnv(env, fileEnv)
+	}
+
+	var optEnv []string
+	for _, kv := range opts.Env {
+		if kv, ok := normalizeEnv(kv); ok {
+			optEnv = append(optEnv, kv)
+		}
+	}
+
+	return mergeEnv(env, optEnv)
+}
+
+var validContainerName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+func checkContainerName(name string) {
+	if name == "" {
+		return
+	}
+	if !validContainerName.MatchString(name) {
+		log.Fatalf("Invalid container name %s, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed\n", name)
+	}
+
+	containers, err := state.List()
+	if err != nil {
+		log.Fatalf("Failed to get container list: %v\n", err)
+	}
+	for _, c := range containers {
+		if c.Name == name {
+			log.Fatalf("Container name %s is already in use by container %s\n", name, c.Id)
+		}
+	}
+}
+
+// applyContainerEnv replaces environment of current process, so command lookup uses PATH of container
+func applyContainerEnv(container *state.Container, user *execUser) {
+	env := append([]string{}, container.Env...)
+	if !hasEnv(env, "HOSTNAME") {
+		env = append(env, "HOSTNAME="+container.Hostname)
+	}
+	if !hasEnv(env, "HOME") {
+		env = append(env, "HOME="+user.Home)
+	}
+
+	os.Clearenv()
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		os.Setenv(key, value)
+	}
+}
+
+func changeToWorkingDir(workingDir string) {
+	if workingDir == "" {
+		return
+	}
+	if err := utils.CreateDirIfNotExist([]string{workingDir}); err != nil {
+		log.Fatalf("Failed to create working directory %s: %v\n", workingDir, err)
+	}
+	if err := os.Chdir(workingDir); err != nil {
+		log.Fatalf("Failed to change to working directory %s: %v\n", workingDir, err)
+	}
+}
+
+// switchUser changes identity of current process, used when command replaces inner-mode process
+func switchUser(user *execUser) error {
+	groups := make([]int, len(user.Groups))
+	for i, gid := range user.Groups {
+		groups[i] = int(gid)
+	}
+	if err := unix.Setgroups(groups); err != nil {
+		return err
+	}
+	if err := unix.Setgid(int(user.Gid)); err != nil {
+		return err
+	}
+
+	return unix.Setuid(int(user.Uid))
+}
+
+// setupContainerCGroup creates cgroup of the container, moves process pid into it and applies resource
+// limits kept in container state
+func setupContainerCGroup(container *state.Container, pid int) error {
+	cgroupManager, err := newCGroupManager(container.Id)
+	if err != nil {
+		return err
+	}
+	if err := cgroupManager.Create(); err != nil {
+		return err
+	}
+	if err := cgroupManager.Apply(pid); err != nil {
+		return err
+	}
+
+	return cgroupManager.Set(&container.Resources)
 }
 
-func SetupContainerExecCommand(
-	mem int,
-	swap int,
-	pids int,
-	cpus float64,
-	containerId string,
-	args []string,
-) {
+func SetupContainerExecCommand(useInit bool, containerId string, args []string) {
 	mountPath := getContainerFSHome(containerId) + "/mnt"
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	container, err := state.Load(containerId)
+	if err != nil {
+		log.Fatalf("Failed to load state of container %s: %v\n", containerId, err)
+	}
 
-	if err := unix.Sethostname([]byte(containerId)); err != nil {
-		log.Fatalf("Failed to set hostname for container %s: %v\n", containerId, err)
+	//Keep mounts of container in its own mount namespace, not propagated back to host
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		log.Fatalf("Failed to make mounts private: %v\n", err)
 	}
 
-	if err := network.JoinContainerNetworkNamespace(containerId); err != nil {
-		log.Fatalf("Failed to join network namespace for container %s: %v\n", containerId, err)
+	if err := unix.Sethostname([]byte(container.Hostname)); err != nil {
+		log.Fatalf("Failed to set hostname for container %s: %v\n", containerId, err)
 	}
 
-	cgroups.CreateCGroup(containerId, true)
-	cgroups.ConfigCGroup(containerId, mem, swap, pids, cpus)
+	//Container on host network stays in network namespace of host
+	netNsOwner := container.Network.GetNamespaceOwner(containerId)
+	if netNsOwner != "" {
+		if err := network.JoinContainerNetworkNamespace(netNsOwner); err != nil {
+			log.Fatalf("Failed to join network namespace for container %s: %v\n", containerId, err)
+		}
+	}
 
-	if err := copyNameserverConfig(containerId); err != nil {
-		log.Fatalf("Failed to copy resolve.conf: %v\n", err)
+	if err := setupContainerCGroup(container, os.Getpid()); err != nil {
+		log.Fatalf("Failed to setup cgroup of container %s: %v\n", containerId, err)
 	}
+
+	//Volumes are mounted later, so files mounted by user take precedence over generated ones
+	mountContainerEtcFiles(container, mountPath)
+	mountContainerVolumes(container, mountPath)
 	if err := unix.Chroot(mountPath); err != nil {
 		log.Fatalf("Failed to chroot: %v\n", err)
 	}
@@ -268,9 +758,48 @@ func SetupContainerExecCommand(
 	if err := unix.Mount("sysfs", "/sys", "sysfs", 0, ""); err != nil {
 		log.Fatalf("Failed to mount sysfs: %v\n", err)
 	}
-	network.SetupLocalInterface()
+	//Loopback of shared namespace is set up by its owner already
+	if netNsOwner == containerId {
+		network.SetupLocalInterface()
+	}
+
+	//User and environment are resolved inside container root
+	user, err := resolveUser(container.User)
+	if err != nil {
+		log.Fatalf("Failed to resolve user %s: %v\n", container.User, err)
+	}
+	applyContainerEnv(container, user)
+	changeToWorkingDir(container.WorkingDir)
+
+	if !useInit {
+		//Without init the command replaces this process and becomes PID 1 of the container
+		cmdPath, err := exec.LookPath(args[0])
+		if err != nil {
+			log.Printf("Failed to find command %s: %v\n", args[0], err)
+			os.Exit(getStartErrorExitCode(err))
+		}
+		if err := switchUser(user); err != nil {
+			log.Fatalf("Failed to switch to user %s: %v\n", container.User, err)
+		}
+		if err := unix.Exec(cmdPath, args, os.Environ()); err != nil {
+			log.Printf("Failed to exec command %s: %v\n", args[0], err)
+			os.Exit(getStartErrorExitCode(err))
+		}
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &unix.SysProcAttr{
+		Credential: &syscall.Credential{Uid: user.Uid, Gid: user.Gid, Groups: user.Groups},
+	}
 
-	cmd.Run()
+	exitCode, err := runAsInit(cmd)
+	if err != nil {
+		log.Printf("Failed to run command %s: %v\n", args[0], err)
+		exitCode = getStartErrorExitCode(err)
+	}
 
 	//Unmount resource
 	if err := unix.Unmount("/dev/pts", 0); err != nil {
@@ -288,30 +817,25 @@ func SetupContainerExecCommand(
 	if err := unix.Unmount("/tmp", 0); err != nil {
 		log.Fatalf("Failed to unmount tmp: %v\n", err)
 	}
+
+	os.Exit(exitCode)
 }
 
-func getPidForRunningContainer(containerId string) int {
-	containers, err := ps.GetRunningContainers()
+// ExecCommandInContainer runs command with args in namespaces and cgroup of a running container, as
+// user and with environment and working directory of the container like its main command
+func ExecCommandInContainer(containerId string, args []string) {
+	if len(args) == 0 {
+		log.Fatalf("No command given to exec in container %s\n", containerId)
+	}
+	container, err := state.Load(containerId)
 	if err != nil {
-		log.Fatalf("Failed to get running containers: %v\n", err)
+		log.Fatalf("Failed to find container %s: %v\n", containerId, err)
 	}
-
-	for _, container := range containers {
-		if container.ContainerId == containerId {
-			return container.Pid
-		}
+	if !container.IsRunning() {
+		log.Fatalf("Container %s is not running\n", containerId)
 	}
 
-	return 0
-}
-
-func ExecCommandInContainer(containerId string) {
-	pid := getPidForRunningContainer(containerId)
-	if pid == 0 {
-		log.Fatalf("Failed to find container %s\n", containerId)
-	}
-
-	baseNsPath := "/proc/" + strconv.Itoa(pid) + "/ns"
+	baseNsPath := "/proc/" + strconv.Itoa(container.Pid) + "/ns"
 	ipcFd, ipcErr := os.Open(baseNsPath + "/ipc")
 	mntFd, mntErr := os.Open(baseNsPath + "/mnt")
 	netFd, netErr := os.Open(baseNsPath + "/net")
@@ -328,19 +852,44 @@ func ExecCommandInContainer(containerId string) {
 	unix.Setns(int(utsFd.Fd()), unix.CLONE_NEWUTS)
 
 	containerMountPath := utils.GetDockerContainerPath() + "/" + containerId + "/fs/mnt"
-	cgroups.CreateCGroup(containerId, false)
+	cgroupManager, err := newCGroupManager(containerId)
+	if err != nil {
+		log.Fatalf("Failed to get cgroup manager of container %s: %v\n", containerId, err)
+	}
+	if err := cgroupManager.Apply(os.Getpid()); err != nil {
+		log.Fatalf("Failed to add process into cgroup of container %s: %v\n", containerId, err)
+	}
 
 	if err := unix.Chroot(containerMountPath); err != nil {
 		log.Fatalf("Failed to chroot for container mount path: %v\n", err)
 	}
 	os.Chdir("/")
 
-	cmd := exec.Command(os.Args[3], os.Args[4:]...)
+	//Same identity, environment and working directory as the main command of the container
+	user, err := resolveUser(container.User)
+	if err != nil {
+		log.Fatalf("Failed to resolve user %s: %v\n", container.User, err)
+	}
+	applyContainerEnv(container, user)
+	changeToWorkingDir(container.WorkingDir)
+
+	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &unix.SysProcAttr{
+		Credential: &syscall.Credential{Uid: user.Uid, Gid: user.Gid, Groups: user.Groups},
+	}
 
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("Failed to exec command in container: %v", err)
+	if err := cmd.Start(); err != nil {
+		log.Printf("Failed to exec command in container: %v", err)
+		os.Exit(getStartErrorExitCode(err))
 	}
+	if err := cmd.Wait(); err != nil {
+		if _, isExitErr := err.(*exec.ExitError); !isExitErr {
+			log.Fatalf("Failed to wait command in container: %v", err)
+		}
+	}
+
+	os.Exit(getProcessExitCode(cmd.ProcessState))
 }
@@ -0,0 +1,80 @@
+package run
+
+import (
+	"go-docker/state"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Max time to wait for a detached container to be started by its shim
+const shimStartTimeout = 10 * time.Second
+
+func getShimLogPath(containerId string) string {
+	return state.GetContainerHome(containerId) + "/shim.log"
+}
+
+// startContainerShim forks the supervisor of a detached container in a new session,
+// so the container is not bound to the terminal and lifetime of the CLI
+func startContainerShim(containerId string) {
+	shimLog, err := os.OpenFile(getShimLogPath(containerId), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatalf("Failed to open shim log of container %s: %v\n", containerId, err)
+	}
+	defer shimLog.Close()
+
+	cmd := exec.Command("/proc/self/exe", "shim", containerId)
+	cmd.Stdout = shimLog
+	cmd.Stderr = shimLog
+	cmd.SysProcAttr = &unix.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("Failed to start shim of container %s: %v\n", containerId, err)
+	}
+	if err := state.Update(containerId, func(c *state.Container) {
+		c.ShimPid = cmd.Process.Pid
+	}); err != nil {
+		log.Printf("Failed to save state of container %s: %v\n", containerId, err)
+	}
+	cmd.Process.Release()
+
+	//Wait until shim reports the container started, or exited already
+	deadline := time.Now().Add(shimStartTimeout)
+	for time.Now().Before(deadline) {
+		container, err := state.Load(containerId)
+		if err == nil && container.Status != state.StatusCreated {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Fatalf("Timeout to wait container %s to start, check %s\n", containerId, getShimLogPath(containerId))
+}
+
+// RunContainerShim supervises a detached container: it owns the inner-mode process and
+// records its exit status in container state after the CLI which started it is gone
+func RunContainerShim(containerId string) {
+	container, err := state.Load(containerId)
+	if err != nil {
+		log.Fatalf("Failed to load state of container %s: %v\n", containerId, err)
+	}
+
+	//Shim is session leader without terminal, hangup shouldn't take the container down
+	signal.Ignore(unix.SIGHUP)
+
+	logWriter, stdoutLog, stderrLog := openContainerLog(container)
+	defer closeContainerLog(logWriter, stdoutLog, stderrLog)
+	cmd, err := startContainerProcess(container, nil, stdoutLog, stderrLog)
+	if err != nil {
+		log.Printf("Failed to start container %s: %v\n", containerId, err)
+		return
+	}
+	exitCode, err := waitContainerProcess(containerId, cmd)
+	if err != nil {
+		log.Printf("Failed to wait container %s: %v\n", containerId, err)
+		return
+	}
+	log.Printf("Container %s exited with code %d\n", containerId, exitCode)
+}
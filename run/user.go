@@ -0,0 +1,125 @@
+package run
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// execUser is the identity the container command runs as
+type execUser struct {
+	Uid    uint32
+	Gid    uint32
+	Groups []uint32
+	Home   string
+}
+
+// readColonFile reads entries of passwd(5) or group(5) style file, missing file gives no entries
+func readColonFile(path string) ([][]string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries [][]string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+
+	return entries, scanner.Err()
+}
+
+func parseId(id string) (uint32, error) {
+	value, err := strconv.ParseUint(id, 10, 32)
+	return uint32(value), err
+}
+
+// resolveUser resolves user spec like name, uid, name:group or uid:gid against /etc/passwd
+// and /etc/group of current root, so it must be called after chroot into the container
+func resolveUser(spec string) (*execUser, error) {
+	user := &execUser{Home: "/"}
+	if spec == "" {
+		return user, nil
+	}
+
+	userSpec, groupSpec, hasGroup := strings.Cut(spec, ":")
+	passwd, err := readColonFile("/etc/passwd")
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	for _, entry := range passwd {
+		if len(entry) < 6 || (entry[0] != userSpec && entry[2] != userSpec) {
+			continue
+		}
+		if user.Uid, err = parseId(entry[2]); err != nil {
+			return nil, fmt.Errorf("invalid uid of user %s: %w", entry[0], err)
+		}
+		if user.Gid, err = parseId(entry[3]); err != nil {
+			return nil, fmt.Errorf("invalid gid of user %s: %w", entry[0], err)
+		}
+		user.Home = entry[5]
+		userSpec = entry[0]
+		found = true
+		break
+	}
+	if !found {
+		//Numeric uid without passwd entry is allowed, same as Docker
+		if user.Uid, err = parseId(userSpec); err != nil {
+			return nil, fmt.Errorf("unable to find user %s in /etc/passwd", userSpec)
+		}
+	}
+
+	groups, err := readColonFile("/etc/group")
+	if err != nil {
+		return nil, err
+	}
+
+	if hasGroup {
+		found = false
+		for _, entry := range groups {
+			if len(entry) < 3 || (entry[0] != groupSpec && entry[2] != groupSpec) {
+				continue
+			}
+			if user.Gid, err = parseId(entry[2]); err != nil {
+				return nil, fmt.Errorf("invalid gid of group %s: %w", entry[0], err)
+			}
+			found = true
+			break
+		}
+		if !found {
+			if user.Gid, err = parseId(groupSpec); err != nil {
+				return nil, fmt.Errorf("unable to find group %s in /etc/group", groupSpec)
+			}
+		}
+	}
+
+	//Supplementary groups are groups listing the user as member
+	user.Groups = []uint32{user.Gid}
+	for _, entry := range groups {
+		if len(entry) < 4 || entry[3] == "" {
+			continue
+		}
+		for _, member := range strings.Split(entry[3], ",") {
+			if member != userSpec {
+				continue
+			}
+			if gid, err := parseId(entry[2]); err == nil && gid != user.Gid {
+				user.Groups = append(user.Groups, gid)
+			}
+		}
+	}
+
+	return user, nil
+}
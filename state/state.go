@@ -0,0 +1,363 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-docker/cgroups"
+	"go-docker/utils"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type Status string
+
+const (
+	StatusCreated Status = "created"
+	StatusRunning Status = "running"
+	StatusExited  Status = "exited"
+)
+
+// Endpoint is the attachment of a container to one network
+type Endpoint struct {
+	NetworkId     string
+	IPAddress     string
+	PrefixLen     int
+	Gateway       string
+	IPv6Address   string
+	PrefixLenV6   int
+	GatewayV6     string
+	MacAddress    string
+	HostVeth      string
+	ContainerVeth string
+	//Extra names of the container on the network, resolved by embedded DNS
+	Aliases []string
+}
+
+// DNSConfig overrides resolver config of host in container
+type DNSConfig struct {
+	Servers []string
+	Search  []string
+	Options []string
+}
+
+type NetworkSettings struct {
+	//Network the container is started on, its gateway is the default route and ports are published to it
+	Mode     string
+	Networks map[string]*Endpoint
+	Ports    []PortBinding
+	Shaping  Shaping
+	//Destinations cidr[:port[/proto]] the container may reach, all traffic is allowed if empty
+	EgressAllow []string `json:",omitempty"`
+	Stats       NetworkStats
+}
+
+// InterfaceStats are traffic counters of a network interface
+type InterfaceStats struct {
+	RxBytes   uint64
+	RxPackets uint64
+	RxErrors  uint64
+	RxDropped uint64
+	TxBytes   uint64
+	TxPackets uint64
+	TxErrors  uint64
+	TxDropped uint64
+}
+
+func (s *InterfaceStats) Add(other *InterfaceStats) {
+	s.RxBytes += other.RxBytes
+	s.RxPackets += other.RxPackets
+	s.RxErrors += other.RxErrors
+	s.RxDropped += other.RxDropped
+	s.TxBytes += other.TxBytes
+	s.TxPackets += other.TxPackets
+	s.TxErrors += other.TxErrors
+	s.TxDropped += other.TxDropped
+}
+
+// sub returns counters gained since last, which are all counters if the interface was created again
+func (s *InterfaceStats) sub(last *InterfaceStats) *InterfaceStats {
+	if s.RxBytes < last.RxBytes || s.TxBytes < last.TxBytes || s.RxPackets < last.RxPackets || s.TxPackets < last.TxPackets {
+		return s
+	}
+
+	return &InterfaceStats{
+		RxBytes:   s.RxBytes - last.RxBytes,
+		RxPackets: s.RxPackets - last.RxPackets,
+		RxErrors:  s.RxErrors - min(s.RxErrors, last.RxErrors),
+		RxDropped: s.RxDropped - min(s.RxDropped, last.RxDropped),
+		TxBytes:   s.TxBytes - last.TxBytes,
+		TxPackets: s.TxPackets - last.TxPackets,
+		TxErrors:  s.TxErrors - min(s.TxErrors, last.TxErrors),
+		TxDropped: s.TxDropped - min(s.TxDropped, last.TxDropped),
+	}
+}
+
+// NetworkStats is running total of traffic of container interfaces. Counters of an interface start over
+// when it is created again, so counters seen last time are kept to tell how much was added since
+type NetworkStats struct {
+	Total InterfaceStats
+	//Counters of container interfaces by name when Total was updated
+	LastSeen map[string]InterfaceStats `json:",omitempty"`
+}
+
+// Update adds traffic of a container interface since it was seen last time to total
+func (n *NetworkStats) Update(name string, current *InterfaceStats) {
+	if n.LastSeen == nil {
+		n.LastSeen = map[string]InterfaceStats{}
+	}
+	last := n.LastSeen[name]
+	n.Total.Add(current.sub(&last))
+	n.LastSeen[name] = *current
+}
+
+// Forget drops counters of an interface which is deleted, its traffic stays in total
+func (n *NetworkStats) Forget(name string) {
+	delete(n.LastSeen, name)
+}
+
+// Shaping is traffic control applied to host side veth of every endpoint, zero values mean no limitation
+type Shaping struct {
+	//Bytes per second
+	Rate uint64 `json:",omitempty"`
+	//Bytes allowed to be sent at once above rate
+	Burst uint64        `json:",omitempty"`
+	Delay time.Duration `json:",omitempty"`
+	//Percent of packets dropped
+	Loss float64 `json:",omitempty"`
+}
+
+func (s *Shaping) IsEmpty() bool {
+	return s.Rate == 0 && s.Delay == 0 && s.Loss == 0
+}
+
+// Network modes which don't attach container to a network, mode of other containers is network name
+const (
+	//Own network namespace with loopback only
+	NetworkModeNone = "none"
+	//No network namespace, container uses network of host
+	NetworkModeHost = "host"
+	//Followed by container ID, container joins network namespace of that container
+	NetworkModeContainerPrefix = "container:"
+)
+
+// UsesNetworks tells if the container is attached to networks, rather than running with a special mode
+func (n *NetworkSettings) UsesNetworks() bool {
+	return n.Mode != NetworkModeNone && n.Mode != NetworkModeHost && !strings.HasPrefix(n.Mode, NetworkModeContainerPrefix)
+}
+
+// GetNamespaceOwner returns ID of container whose network namespace is used by the container,
+// which is the container itself unless it shares namespace of another one, empty for host network
+func (n *NetworkSettings) GetNamespaceOwner(containerId string) string {
+	if n.Mode == NetworkModeHost {
+		return ""
+	}
+	if ownerId, shared := strings.CutPrefix(n.Mode, NetworkModeContainerPrefix); shared {
+		return ownerId
+	}
+
+	return containerId
+}
+
+// PrimaryEndpoint returns endpoint of the network the container is started on, nil if it is disconnected
+func (n *NetworkSettings) PrimaryEndpoint() *Endpoint {
+	return n.Networks[n.Mode]
+}
+
+const (
+	MountTypeBind   = "bind"
+	MountTypeVolume = "volume"
+)
+
+// Mount is a host directory or a volume mounted into container
+type Mount struct {
+	Type        string
+	Name        string `json:",omitempty"`
+	Source      string
+	Destination string
+	ReadOnly    bool
+	Anonymous   bool `json:",omitempty"`
+}
+
+// PortBinding publishes a container port on host, ProxyPid is the userland proxy serving local traffic
+type PortBinding struct {
+	HostIP        string
+	HostPort      int
+	ContainerPort int
+	Protocol      string
+	ProxyPid      int
+}
+
+func (p PortBinding) String() string {
+	return fmt.Sprintf("%s->%d/%s", net.JoinHostPort(p.HostIP, strconv.Itoa(p.HostPort)), p.ContainerPort, p.Protocol)
+}
+
+// LogConfig tells where container output is captured and how log file is rotated
+type LogConfig struct {
+	Path    string
+	MaxSize int64
+	MaxFile int
+}
+
+// Container is the persistent state of one container, saved as state.json in container directory
+type Container struct {
+	Id         string
+	Name       string
+	Hostname   string
+	Image      string
+	ImageHash  string
+	Command    string
+	Args       []string
+	Env        []string
+	WorkingDir string
+	User       string
+	StopSignal string
+	Resources  cgroups.Resources
+	Mounts     []Mount
+	Init       bool
+	Network    NetworkSettings
+	DNS        DNSConfig
+	//Entries name:ip added to hosts file of container
+	ExtraHosts []string
+	Log        LogConfig
+	Pid        int
+	ShimPid    int
+	Detached   bool
+	Status     Status
+	ExitCode   int
+	Created    time.Time
+	Started    time.Time
+	Finished   time.Time
+}
+
+func GetContainerHome(containerId string) string {
+	return utils.GetDockerContainerPath() + "/" + containerId
+}
+
+func getStatePath(containerId string) string {
+	return GetContainerHome(containerId) + "/state.json"
+}
+
+func getLockPath(containerId string) string {
+	return GetContainerHome(containerId) + "/state.lock"
+}
+
+// Save writes container state to disk, through a temp file so readers never see a partial file
+func Save(c *Container) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	statePath := getStatePath(c.Id)
+	tempPath := statePath + ".tmp"
+	if err := os.WriteFile(tempPath, data, utils.File_OtherReadOnly); err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, statePath)
+}
+
+func Load(containerId string) (*Container, error) {
+	data, err := os.ReadFile(getStatePath(containerId))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Container{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("failed to parse state of container %s: %w", containerId, err)
+	}
+
+	return c, nil
+}
+
+// Update loads, modifies and saves container state while holding a lock of the container
+func Update(containerId string, modify func(c *Container)) error {
+	lockFile, err := os.OpenFile(getLockPath(containerId), os.O_CREATE|os.O_RDWR, utils.File_OtherReadOnly)
+	if err != nil {
+		return err
+	}
+	defer lockFile.Close()
+
+	if err := unix.Flock(int(lockFile.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+	defer unix.Flock(int(lockFile.Fd()), unix.LOCK_UN)
+
+	c, err := Load(containerId)
+	if err != nil {
+		return err
+	}
+	modify(c)
+
+	return Save(c)
+}
+
+// List returns states of all containers which have a state file
+func List() ([]*Container, error) {
+	var containers []*Container
+
+	entries, err := os.ReadDir(utils.GetDockerContainerPath())
+	if os.IsNotExist(err) {
+		return containers, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		c, err := Load(entry.Name())
+		if err != nil {
+			continue
+		}
+		containers = append(containers, c)
+	}
+
+	return containers, nil
+}
+
+// Resolve finds container by full ID, name or unique ID prefix
+func Resolve(idOrName string) (*Container, error) {
+	if idOrName == "" {
+		return nil, fmt.Errorf("empty container ID or name")
+	}
+
+	containers, err := List()
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []*Container
+	for _, c := range containers {
+		if c.Id == idOrName || c.Name == idOrName {
+			return c, nil
+		}
+		if strings.HasPrefix(c.Id, idOrName) {
+			matched = append(matched, c)
+		}
+	}
+
+	if len(matched) == 1 {
+		return matched[0], nil
+	} else if len(matched) > 1 {
+		return nil, fmt.Errorf("multiple containers match %s", idOrName)
+	}
+
+	return nil, fmt.Errorf("no such container %s", idOrName)
+}
+
+// IsRunning checks both recorded status and the main process, in case the container died without updating state
+func (c *Container) IsRunning() bool {
+	if c.Status != StatusRunning || c.Pid <= 0 {
+		return false
+	}
+
+	return unix.Kill(c.Pid, 0) == nil
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 type Manifest []struct {
@@ -17,14 +18,20 @@ type Manifest []struct {
 	Layers   []string
 }
 
-var Commands = []string{"run", "inner-mode", "setup-netns", "setup-veth", "ps", "exec", "images", "clean", "rmImage"}
+var Commands = []string{"run", "inner-mode", "shim", "port-proxy", "dns-server", "setup-netns", "setup-veth", "ps", "stats", "inspect", "logs", "stop", "kill", "restart", "update", "exec", "volume", "network", "system", "images", "clean", "rmImage"}
 
 const dockerHomePath = "/var/lib/go-docker"
 const dockerTempPath = dockerHomePath + "/tmp"
 const dockerImagesPath = dockerHomePath + "/images"
+const dockerVolumesPath = dockerHomePath + "/volumes"
+const dockerNetworkPath = dockerHomePath + "/network"
 const dockerContainersPath = "/var/run/go-docker/containers"
 const dockerNetNsPath = "/var/run/go-docker/net-ns"
 
+// Default directories of CNI network configs and plugin binaries, the same as other CNI runtimes
+const cniConfPath = "/etc/cni/net.d"
+const cniBinPath = "/opt/cni/bin"
+
 const File_OtherReadExecute = 0755
 const File_OtherNoPermit = 0700
 const File_OtherReadOnly = 0644
@@ -42,6 +49,14 @@ func GetDockerImagePath() string {
 	return dockerImagesPath
 }
 
+func GetDockerVolumePath() string {
+	return dockerVolumesPath
+}
+
+func GetDockerNetworkPath() string {
+	return dockerNetworkPath
+}
+
 func GetDockerContainerPath() string {
 	return dockerContainersPath
 }
@@ -50,12 +65,46 @@ func GetDockerNetNsPath() string {
 	return dockerNetNsPath
 }
 
+func GetCNIConfPath() string {
+	return cniConfPath
+}
+
+func GetCNIBinPath() string {
+	return cniBinPath
+}
+
+// StringList is a flag value which can be given multiple times
+type StringList []string
+
+func (l *StringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *StringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func ShowGuide() {
 	fmt.Println("Welcome to Go-Docker!")
 	fmt.Println("Supported commands:")
-	fmt.Println("go-docker run [--mem] [--swap] [--pids] [--cpus] <image> <command>")
+	fmt.Println("go-docker run [-d] [--init] [--name] [-e KEY=VAL] [--env-file] [-w workdir] [-u user[:group]] [-h hostname] [-v src:dst[:ro]] [--mount] [-p [ip:]hostPort:containerPort[/proto]] [--network name|none|host|container:<id>] [--ip addr] [--ip6 addr] [--network-alias name] [--dns ip] [--dns-search domain] [--dns-option opt] [--add-host name:ip] [--net-rate rate] [--net-burst size] [--net-delay duration] [--net-loss percent] [--egress-allow cidr[:port[/proto]]] [--mem] [--swap] [--pids] [--cpus] [--log-max-size] [--log-max-file] <image> [command]")
 	fmt.Println("go-docker ps")
+	fmt.Println("go-docker stats [containerId...]")
+	fmt.Println("go-docker inspect <containerId>")
+	fmt.Println("go-docker logs [-f] [--since] [--tail N] [--timestamps] <containerId>")
+	fmt.Println("go-docker stop [-t seconds] <containerId>")
+	fmt.Println("go-docker kill [-s signal] <containerId>")
+	fmt.Println("go-docker restart [-t seconds] <containerId>")
+	fmt.Println("go-docker update [--net-rate rate] [--net-burst size] [--net-delay duration] [--net-loss percent] <containerId>")
 	fmt.Println("go-docker exec <containerId> <command>")
+	fmt.Println("go-docker volume create|ls|inspect|rm|prune [name]")
+	fmt.Println("go-docker network create [-d bridge|macvlan|ipvlan|cni] [--parent iface] [--cni-conf-dir dir] [--cni-bin-dir dir] [--icc=false] [--subnet cidr] [--gateway ip] [--ipv6] [--subnet-v6 cidr] [--gateway-v6 ip] <name>")
+	fmt.Println("go-docker network ls|inspect|rm [name]")
+	fmt.Println("go-docker network connect [--ip addr] [--ip6 addr] [--alias name] <network> <containerId>")
+	fmt.Println("go-docker network disconnect <network> <containerId>")
+	fmt.Println("go-docker network prune [--dry-run]")
+	fmt.Println("go-docker system reconcile [--dry-run]")
 	fmt.Println("go-docker images")
 	fmt.Println("go-docker clean <containerId>")
 	fmt.Println("go-docker rmImage <imageId>")
@@ -84,7 +133,7 @@ func CreateDirIfNotExist(dirs []string) error {
 }
 
 func InitDockerDirs() error {
-	dirs := []string{dockerHomePath, dockerImagesPath, dockerNetNsPath, dockerContainersPath, dockerTempPath}
+	dirs := []string{dockerHomePath, dockerImagesPath, dockerVolumesPath, dockerNetworkPath, dockerNetNsPath, dockerContainersPath, dockerTempPath}
 	return CreateDirIfNotExist(dirs)
 }
 
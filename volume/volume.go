@@ -0,0 +1,415 @@
+package volume
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go-docker/state"
+	"go-docker/utils"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Volume is a directory managed by go-docker which keeps data independent of container lifetime
+type Volume struct {
+	Name       string
+	Mountpoint string
+	Anonymous  bool
+	Created    time.Time
+}
+
+var validVolumeName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+func getVolumeHome(name string) string {
+	return utils.GetDockerVolumePath() + "/" + name
+}
+
+func getMetadataPath(name string) string {
+	return getVolumeHome(name) + "/volume.json"
+}
+
+func createVolumeName() string {
+	randBytes := make([]byte, 16)
+	rand.Read(randBytes)
+
+	return hex.EncodeToString(randBytes)
+}
+
+func Get(name string) (*Volume, error) {
+	data, err := os.ReadFile(getMetadataPath(name))
+	if err != nil {
+		return nil, err
+	}
+
+	vol := &Volume{}
+	if err := json.Unmarshal(data, vol); err != nil {
+		return nil, fmt.Errorf("failed to parse volume %s: %w", name, err)
+	}
+
+	return vol, nil
+}
+
+// Create creates a volume, or returns the existing one with the same name.
+// Empty name creates an anonymous volume with a random name
+func Create(name string) (*Volume, error) {
+	anonymous := name == ""
+	if anonymous {
+		name = createVolumeName()
+	}
+	if !validVolumeName.MatchString(name) {
+		return nil, fmt.Errorf("invalid volume name %s, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+	if vol, err := Get(name); err == nil {
+		return vol, nil
+	}
+
+	vol := &Volume{
+		Name:       name,
+		Mountpoint: getVolumeHome(name) + "/_data",
+		Anonymous:  anonymous,
+		Created:    time.Now(),
+	}
+	if err := os.MkdirAll(vol.Mountpoint, utils.File_OtherReadExecute); err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(vol, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(getMetadataPath(name), data, utils.File_OtherReadOnly); err != nil {
+		return nil, err
+	}
+
+	return vol, nil
+}
+
+func List() ([]*Volume, error) {
+	var volumes []*Volume
+
+	entries, err := os.ReadDir(utils.GetDockerVolumePath())
+	if os.IsNotExist(err) {
+		return volumes, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if vol, err := Get(entry.Name()); err == nil {
+			volumes = append(volumes, vol)
+		}
+	}
+
+	return volumes, nil
+}
+
+// getUsers returns IDs of containers which mount the volume, stopped containers included
+func getUsers(name string) ([]string, error) {
+	var users []string
+
+	containers, err := state.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range containers {
+		for _, mount := range c.Mounts {
+			if mount.Type == state.MountTypeVolume && mount.Name == name {
+				users = append(users, c.Id)
+				break
+			}
+		}
+	}
+
+	return users, nil
+}
+
+func Remove(name string) error {
+	if _, err := Get(name); err != nil {
+		return fmt.Errorf("no such volume %s", name)
+	}
+
+	users, err := getUsers(name)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("volume %s is in use by container %s", name, strings.Join(users, ", "))
+	}
+
+	return os.RemoveAll(getVolumeHome(name))
+}
+
+// Prune removes all volumes which are not used by any container
+func Prune() ([]string, error) {
+	var removed []string
+
+	volumes, err := List()
+	if err != nil {
+		return nil, err
+	}
+	for _, vol := range volumes {
+		users, err := getUsers(vol.Name)
+		if err != nil {
+			return removed, err
+		}
+		if len(users) > 0 {
+			continue
+		}
+		if err := os.RemoveAll(getVolumeHome(vol.Name)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, vol.Name)
+	}
+
+	return removed, nil
+}
+
+// ParseVolumeSpec parses -v option: host-path:container-path[:ro|rw] as bind mount,
+// name:container-path[:ro|rw] as named volume, or container-path as anonymous volume.
+// Host path may contain ":" itself, so the spec is split from the right
+func ParseVolumeSpec(spec string) (state.Mount, error) {
+	mount := state.Mount{}
+	rest := spec
+
+	//Last field is a mode only if it is not the container path, which must be absolute
+	if i := strings.LastIndex(rest, ":"); i >= 0 && !filepath.IsAbs(rest[i+1:]) && strings.Contains(rest[:i], ":") {
+		switch rest[i+1:] {
+		case "ro":
+			mount.ReadOnly = true
+		case "rw":
+		default:
+			return mount, fmt.Errorf("invalid mode %s of volume %s", rest[i+1:], spec)
+		}
+		rest = rest[:i]
+	}
+
+	source, destination := "", rest
+	if i := strings.LastIndex(rest, ":"); i >= 0 {
+		source, destination = rest[:i], rest[i+1:]
+		if source == "" {
+			return mount, fmt.Errorf("invalid volume %s", spec)
+		}
+	}
+
+	switch {
+	case source == "":
+		mount.Type = state.MountTypeVolume
+		mount.Anonymous = true
+	case filepath.IsAbs(source):
+		mount.Type = state.MountTypeBind
+		mount.Source = filepath.Clean(source)
+	default:
+		mount.Type = state.MountTypeVolume
+		mount.Name = source
+	}
+	mount.Destination = destination
+
+	if !filepath.IsAbs(mount.Destination) {
+		return mount, fmt.Errorf("container path of volume %s must be absolute", spec)
+	}
+	mount.Destination = filepath.Clean(mount.Destination)
+
+	return mount, nil
+}
+
+// ParseMountSpec parses --mount option: type=bind|volume,source=...,target=...[,readonly]
+func ParseMountSpec(spec string) (state.Mount, error) {
+	mount := state.Mount{Type: state.MountTypeVolume}
+	source := ""
+
+	for _, field := range strings.Split(spec, ",") {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "type":
+			if value != state.MountTypeBind && value != state.MountTypeVolume {
+				return mount, fmt.Errorf("unsupported mount type %s", value)
+			}
+			mount.Type = value
+		case "source", "src":
+			source = value
+		case "target", "destination", "dst":
+			mount.Destination = value
+		case "readonly", "ro":
+			mount.ReadOnly = value == "" || value == "true" || value == "1"
+		default:
+			return mount, fmt.Errorf("unknown mount option %s", key)
+		}
+	}
+
+	if mount.Type == state.MountTypeBind {
+		if !filepath.IsAbs(source) {
+			return mount, fmt.Errorf("source of bind mount %s must be an absolute path", spec)
+		}
+		mount.Source = filepath.Clean(source)
+	} else {
+		mount.Name = source
+		mount.Anonymous = source == ""
+	}
+
+	if !filepath.IsAbs(mount.Destination) {
+		return mount, fmt.Errorf("target of mount %s must be an absolute path", spec)
+	}
+	mount.Destination = filepath.Clean(mount.Destination)
+
+	return mount, nil
+}
+
+// PrepareMounts creates volumes referenced by mounts and fills in their host paths,
+// paths declared as volumes in image get anonymous volumes unless they are mounted already.
+// Sources of bind mounts are all checked before any volume is created
+func PrepareMounts(mounts []state.Mount, imageVolumes map[string]struct{}) []state.Mount {
+	for _, mount := range mounts {
+		if mount.Type != state.MountTypeBind {
+			continue
+		}
+		if _, err := os.Stat(mount.Source); err != nil {
+			log.Fatalf("Invalid source of bind mount %s: %v\n", mount.Source, err)
+		}
+	}
+
+	mounted := map[string]bool{}
+	for _, mount := range mounts {
+		mounted[mount.Destination] = true
+	}
+	for path := range imageVolumes {
+		path = filepath.Clean(path)
+		if !mounted[path] {
+			mounts = append(mounts, state.Mount{Type: state.MountTypeVolume, Anonymous: true, Destination: path})
+			mounted[path] = true
+		}
+	}
+
+	for i := range mounts {
+		mount := &mounts[i]
+		if mount.Type == state.MountTypeBind {
+			continue
+		}
+
+		vol, err := Create(mount.Name)
+		if err != nil {
+			log.Fatalf("Failed to create volume for %s: %v\n", mount.Destination, err)
+		}
+		mount.Name = vol.Name
+		mount.Source = vol.Mountpoint
+	}
+
+	return mounts
+}
+
+// Populate copies content of src, a directory in image, into an empty volume mounted at mountpoint, so
+// the volume starts with what image has at its path like in Docker. Mode and owner of src are kept, and
+// symlinks are copied as they are, never followed
+func Populate(mountpoint string, src string) error {
+	info, err := os.Lstat(src)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return nil
+	}
+	entries, err := os.ReadDir(mountpoint)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return nil
+	}
+
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		return copyEntry(path, filepath.Join(mountpoint, rel), info)
+	})
+}
+
+func copyEntry(src, dest string, info os.FileInfo) error {
+	switch {
+	case info.IsDir():
+		if err := os.MkdirAll(dest, info.Mode().Perm()); err != nil {
+			return err
+		}
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dest); err != nil {
+			return err
+		}
+		return copyOwner(dest, info)
+	case info.Mode().IsRegular():
+		if err := utils.CopyFile(src, dest); err != nil {
+			return err
+		}
+	default:
+		//Devices, sockets and pipes are not expected in volume content of images
+		return nil
+	}
+
+	if err := os.Chmod(dest, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+
+	return copyOwner(dest, info)
+}
+
+func copyOwner(dest string, info os.FileInfo) error {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return os.Lchown(dest, int(stat.Uid), int(stat.Gid))
+	}
+
+	return nil
+}
+
+// RemoveAnonymousVolumes removes anonymous volumes created for a container when it is cleaned
+func RemoveAnonymousVolumes(container *state.Container) {
+	for _, mount := range container.Mounts {
+		if mount.Type != state.MountTypeVolume || !mount.Anonymous {
+			continue
+		}
+		if err := os.RemoveAll(getVolumeHome(mount.Name)); err != nil {
+			log.Printf("Failed to remove volume %s: %v\n", mount.Name, err)
+		}
+	}
+}
+
+func PrintVolumes() {
+	volumes, err := List()
+	if err != nil {
+		log.Fatalf("Failed to list volumes: %v\n", err)
+	}
+
+	fmt.Println("VOLUME NAME\tMOUNTPOINT")
+	for _, vol := range volumes {
+		fmt.Printf("%s\t%s\n", vol.Name, vol.Mountpoint)
+	}
+}
+
+func InspectVolume(name string) {
+	vol, err := Get(name)
+	if err != nil {
+		log.Fatalf("Failed to find volume %s: %v\n", name, err)
+	}
+
+	data, err := json.MarshalIndent(vol, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to marshal volume %s: %v\n", name, err)
+	}
+	fmt.Println(string(data))
+}
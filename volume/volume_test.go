@@ -0,0 +1,113 @@
+package volume
+
+import (
+	"go-docker/state"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseVolumeSpec(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    state.Mount
+		wantErr bool
+	}{
+		{spec: "/data", want: state.Mount{Type: state.MountTypeVolume, Anonymous: true, Destination: "/data"}},
+		{spec: "/data/", want: state.Mount{Type: state.MountTypeVolume, Anonymous: true, Destination: "/data"}},
+		{spec: "cache:/var/cache", want: state.Mount{Type: state.MountTypeVolume, Name: "cache", Destination: "/var/cache"}},
+		{spec: "cache:/var/cache:ro", want: state.Mount{Type: state.MountTypeVolume, Name: "cache", Destination: "/var/cache", ReadOnly: true}},
+		{spec: "/srv/app:/app", want: state.Mount{Type: state.MountTypeBind, Source: "/srv/app", Destination: "/app"}},
+		{spec: "/srv/app/../app:/app:rw", want: state.Mount{Type: state.MountTypeBind, Source: "/srv/app", Destination: "/app"}},
+		{spec: "/srv/a:b:/app", want: state.Mount{Type: state.MountTypeBind, Source: "/srv/a:b", Destination: "/app"}},
+		{spec: "/srv/a:b:/app:ro", want: state.Mount{Type: state.MountTypeBind, Source: "/srv/a:b", Destination: "/app", ReadOnly: true}},
+		{spec: "/srv/12:00:00:/logs", want: state.Mount{Type: state.MountTypeBind, Source: "/srv/12:00:00", Destination: "/logs"}},
+		{spec: "data", wantErr: true},
+		{spec: "cache:var/cache", wantErr: true},
+		{spec: "/data:ro", wantErr: true},
+		{spec: "/srv/app:/app:rx", wantErr: true},
+		{spec: ":/app", wantErr: true},
+		{spec: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseVolumeSpec(test.spec)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseVolumeSpec(%q) = %+v, want error", test.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseVolumeSpec(%q) failed: %v", test.spec, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseVolumeSpec(%q) = %+v, want %+v", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestPopulateCopiesImageContent(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "data")
+	mountpoint := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "file"), []byte("content"), 0604); err != nil {
+		t.Fatal(err)
+	}
+	//Absolute link only makes sense inside the container, it must not be followed on host
+	if err := os.Symlink("/etc/passwd", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(src, 0710); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Populate(mountpoint, src); err != nil {
+		t.Fatalf("Populate failed: %v", err)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(mountpoint, "sub", "file")); err != nil || string(data) != "content" {
+		t.Errorf("Copied file has %q, %v, want content", data, err)
+	}
+	if info, err := os.Stat(filepath.Join(mountpoint, "sub", "file")); err != nil || info.Mode().Perm() != 0604 {
+		t.Errorf("Copied file mode %v, %v, want 0604", info.Mode(), err)
+	}
+	if info, err := os.Stat(mountpoint); err != nil || info.Mode().Perm() != 0710 {
+		t.Errorf("Volume root mode %v, %v, want mode of image directory 0710", info.Mode(), err)
+	}
+	if target, err := os.Readlink(filepath.Join(mountpoint, "link")); err != nil || target != "/etc/passwd" {
+		t.Errorf("Copied link points to %q, %v, want /etc/passwd", target, err)
+	}
+}
+
+func TestPopulateKeepsExistingContent(t *testing.T) {
+	src := t.TempDir()
+	mountpoint := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "image"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(mountpoint, "existing"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Populate(mountpoint, src); err != nil {
+		t.Fatalf("Populate failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(mountpoint, "image")); !os.IsNotExist(err) {
+		t.Errorf("Image content copied into volume which has data")
+	}
+}
+
+func TestPopulateWithoutImageContent(t *testing.T) {
+	mountpoint := t.TempDir()
+	if err := Populate(mountpoint, filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Fatalf("Populate failed for path missing in image: %v", err)
+	}
+	entries, err := os.ReadDir(mountpoint)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Volume has %v, %v, want it empty", entries, err)
+	}
+}